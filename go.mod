@@ -1,13 +1,11 @@
 module proxyReptile
 
-go 1.12
+go 1.15
 
 require (
-	github.com/PuerkitoBio/goquery v1.5.0 // indirect
-	github.com/gin-gonic/gin v1.5.0 // indirect
-	github.com/parnurzeal/gorequest v0.2.16 // indirect
-	github.com/pkg/errors v0.8.1 // indirect
-	github.com/sirupsen/logrus v1.4.2 // indirect
-	github.com/tidwall/gjson v1.3.5 // indirect
-	moul.io/http2curl v1.0.0 // indirect
+	github.com/PuerkitoBio/goquery v1.5.0
+	github.com/gin-gonic/gin v1.5.0
+	github.com/oschwald/maxminddb-golang v1.3.1
+	github.com/sirupsen/logrus v1.4.2
+	github.com/tidwall/gjson v1.3.5
 )
@@ -1,23 +1,38 @@
 package main
 
 import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/gin-gonic/gin"
-	"github.com/parnurzeal/gorequest"
+	"github.com/oschwald/maxminddb-golang"
 	"github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -28,11 +43,97 @@ var timeout = 5 * time.Second
 var retry = 3
 var pageMax = 5
 
-var checkProxyChan = make(chan string)
+var checkProtocols = []string{"http", "socks5", "https", "socks4", "socks4a"}
+var timingSampleMax = 10
+var timingEwmaAlpha = 0.3
+var recheckInterval = 10 * time.Minute
+var scoreEwmaAlpha = 0.3
+var scoreMin = 0.3
+var recheckTick = 5 * time.Second
+var autoScaleTick = 10 * time.Second
+var autoScaleFailRateMax = 0.95
+var negativeCacheSize = 10000
+var negativeCacheBackoff = 10 * time.Minute
+var negativeCacheBackoffMax = 24 * time.Hour
+
+type candidate struct {
+	proxy  string
+	source string
+	trust  string
+}
+
+type Proxy struct {
+	Address     string        `json:"address"`
+	Protocol    string        `json:"protocol"`
+	Protocols   []string      `json:"protocols"`
+	Latency     time.Duration `json:"latency"`
+	LatencyEwma time.Duration `json:"latencyEwma"`
+	Timings     []Timing      `json:"timings"`
+	Sources     []string      `json:"sources"`
+	FirstSeen   time.Time     `json:"firstSeen"`
+	LastChecked time.Time     `json:"lastChecked"`
+	FailCount   int           `json:"failCount"`
+	NextCheck   time.Time     `json:"nextCheck"`
+	//验证成功率的EWMA，低于scoreMin时移出代理池
+	Score float64 `json:"score"`
+	//每个验证方案是否通过
+	Profiles  map[string]bool `json:"profiles"`
+	Anonymity string          `json:"anonymity"`
+	ExitIp    string          `json:"exitIp"`
+	Tampered  bool            `json:"tampered"`
+	//验证过的转发能力：http代理的plain、connect443、connect-any，socks代理的socks4、socks4a、socks5h
+	Capabilities []string `json:"capabilities"`
+	//需要认证的代理，为空表示不需要认证
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	//根据出口ip查询地理信息库得到，Country是ISO国家代码
+	Country string `json:"country"`
+	City    string `json:"city"`
+	Asn     uint   `json:"asn"`
+	Org     string `json:"org"`
+	//datacenter、residential或unknown
+	IpType string `json:"ipType"`
+	//最近一次带宽测试的下载速度，单位KB/s，下载失败为0
+	Throughput        float64   `json:"throughput"`
+	ThroughputChecked time.Time `json:"throughputChecked"`
+}
 
 var globalProxiesLock sync.Mutex
-var globalProxies []string
-var globalProxiesMap = make(map[string]string)
+var globalProxies []*Proxy
+var globalProxiesMap = make(map[string]*Proxy)
+
+var sourcePath = "source.json"
+var peerPath = "peer.json"
+var targetPath = "target.json"
+var profilePath = "profile.json"
+var judgeUrl = os.Getenv("JUDGE_URL")
+var realIp = os.Getenv("REAL_IP")
+var echoUrl = os.Getenv("ECHO_URL")
+var listToken = os.Getenv("LIST_TOKEN")
+var adminToken = os.Getenv("ADMIN_TOKEN")
+var sourceFailMax = 3
+var sourceCooldown = 30 * time.Minute
+var sourceCooldownMax = 24 * time.Hour
+var sourceIntervalMax = 8
+var sourceSurviveAge = time.Hour
+var sourceStatWindow = 24 * time.Hour
+var flushInterval = time.Minute
+var tcpCheckThreadCount = 64
+var handshakeCheckThreadCount = 32
+var targetCheckThreadCount = 16
+var extraCheckThreadCount = 8
+var throughputCheckThreadCount = 4
+var throughputUrl = os.Getenv("THROUGHPUT_URL")
+var throughputSize = 1024 * 1024
+var throughputSizeMax = 16 * 1024 * 1024
+var throughputTimeout = 30 * time.Second
+var throughputInterval = 6 * time.Hour
+var serviceWaitGroup sync.WaitGroup
+var geoReloadTick = time.Minute
+var sniffGrace = 500 * time.Millisecond
+var plainCheckUrl = os.Getenv("PLAIN_CHECK_URL")
+var connect443Address = os.Getenv("CONNECT_443_ADDRESS")
+var connectAnyAddress = os.Getenv("CONNECT_ANY_ADDRESS")
 
 func init() {
 	checkProxyMaxThreadCountString := os.Getenv("CHECK_PROXY_MAX_THREAD_COUNT")
@@ -40,287 +141,3170 @@ func init() {
 	if err != nil {
 		checkProxyMaxThreadCount = 16
 	}
-	for i := 0; i < checkProxyMaxThreadCount; i++ {
-		go checkAndAddProxy()
+	if failMax, err := strconv.Atoi(os.Getenv("SOURCE_FAIL_MAX")); err == nil && failMax > 0 {
+		sourceFailMax = failMax
+	}
+	if cooldown, err := time.ParseDuration(os.Getenv("SOURCE_COOLDOWN")); err == nil && cooldown > 0 {
+		sourceCooldown = cooldown
+	}
+	if interval, err := time.ParseDuration(os.Getenv("RECHECK_INTERVAL")); err == nil && interval > 0 {
+		recheckInterval = interval
+	}
+	if min, err := strconv.ParseFloat(os.Getenv("PROXY_SCORE_MIN"), 64); err == nil && min >= 0 {
+		scoreMin = min
+	}
+	if size, err := strconv.Atoi(os.Getenv("NEGATIVE_CACHE_SIZE")); err == nil && size > 0 {
+		negativeCacheSize = size
+	}
+	if backoff, err := time.ParseDuration(os.Getenv("NEGATIVE_CACHE_BACKOFF")); err == nil && backoff > 0 {
+		negativeCacheBackoff = backoff
+	}
+	if cooldownMax, err := time.ParseDuration(os.Getenv("SOURCE_COOLDOWN_MAX")); err == nil && cooldownMax > 0 {
+		sourceCooldownMax = cooldownMax
+	}
+	if intervalMax, err := strconv.Atoi(os.Getenv("SOURCE_INTERVAL_MAX")); err == nil && intervalMax > 0 {
+		sourceIntervalMax = intervalMax
+	}
+	if surviveAge, err := time.ParseDuration(os.Getenv("SOURCE_SURVIVE_AGE")); err == nil && surviveAge > 0 {
+		sourceSurviveAge = surviveAge
+	}
+	if path := os.Getenv("GEOIP_CITY_DB"); path != "" {
+		geoCityDatabase.path = path
+	}
+	if path := os.Getenv("GEOIP_ASN_DB"); path != "" {
+		geoAsnDatabase.path = path
+	}
+	if paths := splitPaths(os.Getenv("DATACENTER_LIST")); len(paths) > 0 {
+		datacenterList.paths = paths
+	}
+	if paths := splitPaths(os.Getenv("RESIDENTIAL_LIST")); len(paths) > 0 {
+		residentialList.paths = paths
+	}
+	if paths := splitPaths(os.Getenv("ALLOW_LIST")); len(paths) > 0 {
+		allowList.paths = paths
+	}
+	if paths := splitPaths(os.Getenv("DENY_LIST")); len(paths) > 0 {
+		denyList.paths = paths
+	}
+	if tick, err := time.ParseDuration(os.Getenv("GEOIP_RELOAD_INTERVAL")); err == nil && tick > 0 {
+		geoReloadTick = tick
+	}
+	tcpCheckThreadCount = envThreadCount("TCP_CHECK_THREAD_COUNT", tcpCheckThreadCount)
+	handshakeCheckThreadCount = envThreadCount("HANDSHAKE_CHECK_THREAD_COUNT", handshakeCheckThreadCount)
+	targetCheckThreadCount = checkProxyMaxThreadCount
+	extraCheckThreadCount = envThreadCount("EXTRA_CHECK_THREAD_COUNT", extraCheckThreadCount)
+	throughputCheckThreadCount = envThreadCount("THROUGHPUT_CHECK_THREAD_COUNT", throughputCheckThreadCount)
+	if size, err := strconv.Atoi(os.Getenv("THROUGHPUT_SIZE")); err == nil && size > 0 && size <= throughputSizeMax {
+		throughputSize = size
+	}
+	if throughputTimeoutValue, err := time.ParseDuration(os.Getenv("THROUGHPUT_TIMEOUT")); err == nil && throughputTimeoutValue > 0 {
+		throughputTimeout = throughputTimeoutValue
+	}
+	if throughputIntervalValue, err := time.ParseDuration(os.Getenv("THROUGHPUT_INTERVAL")); err == nil && throughputIntervalValue >= 0 {
+		throughputInterval = throughputIntervalValue
+	}
+	//没有单独配置下载地址时，用judge服务的/payload
+	if throughputUrl == "" && os.Getenv("THROUGHPUT_CHECK") == "true" && strings.HasSuffix(judgeUrl, "/judge") {
+		throughputUrl = fmt.Sprintf("%s/payload", strings.TrimSuffix(judgeUrl, "/judge"))
+	}
+}
+
+//读取配置和数据文件，放在main里而不是init里，测试时不会在代码目录下创建文件
+func loadData() {
+	loadCheckProfiles()
+	deriveCapabilityTargets()
+	reloadGeoDatabases()
+	reloadNetworkLists()
+	loadPeers()
+	loadSources()
+	loadGlobalProxies()
+}
+
+func envThreadCount(name string, defaultCount int) int {
+	count, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || count <= 0 {
+		return defaultCount
+	}
+	return count
+}
+
+//收到退出信号后取消ctx，等所有抓取、验证的goroutine退出后保存数据
+func main() {
+	loadData()
+	ctx, cancel := context.WithCancel(context.Background())
+	startCheckStages(ctx, tcpCheckThreadCount, handshakeCheckThreadCount, targetCheckThreadCount, extraCheckThreadCount, throughputCheckThreadCount)
+	runService(ctx, autoFlushProxy)
+	runService(ctx, autoRecheckProxy)
+	runService(ctx, autoReloadGeoDatabases)
+	if os.Getenv("CHECK_AUTO_SCALE") == "true" {
+		runService(ctx, autoScaleCheckStages)
+	}
+	server := startWebService(cancel)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.WithFields(logrus.Fields{"signal": sig}).Info("收到退出信号，停止服务")
+	case <-ctx.Done():
+	}
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), timeout)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("关闭web服务失败")
+	}
+	serviceWaitGroup.Wait()
+	saveSources()
+	saveGlobalProxies()
+	log.Info("服务已停止")
+}
+
+func runService(ctx context.Context, service func(ctx context.Context)) {
+	serviceWaitGroup.Add(1)
+	go func() {
+		defer serviceWaitGroup.Done()
+		service(ctx)
+	}()
+}
+
+//ctx取消时返回false
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+func startWebService(stop func()) *http.Server {
+	log.Info("开始web服务")
+	engine := gin.Default()
+	engine.POST("/add", func(context *gin.Context) {
+		proxiesString := context.PostForm("proxies")
+		//代理数据里可能带认证信息，不写进日志
+		log.WithFields(logrus.Fields{"length": len(proxiesString)}).Info("添加代理数据json")
+		context.JSON(http.StatusOK, createResponseData(proxiesString, addProxyByJson(proxiesString)))
+	})
+	engine.GET("/get", func(context *gin.Context) {
+		context.JSON(http.StatusOK, createResponseData(getProxy(parseProxyFilter(context)), nil))
+	})
+	engine.GET("/list", checkListToken, func(context *gin.Context) {
+		proxies := listProxies(parseProxyFilter(context))
+		if context.Query("sort") == "latency" {
+			sortProxiesByLatency(proxies)
+		}
+		if !isAdmin(context) {
+			for i := range proxies {
+				proxies[i] = proxies[i].redacted()
+			}
+		}
+		context.JSON(http.StatusOK, createResponseData(proxies, nil))
+	})
+	engine.GET("/exit", checkListToken, func(context *gin.Context) {
+		context.JSON(http.StatusOK, createResponseData(listExitGroups(), nil))
+	})
+	engine.GET("/judge", func(context *gin.Context) {
+		context.JSON(http.StatusOK, createResponseData(judge(context.Request), nil))
+	})
+	//带宽测试经过被测的代理访问，不能带token，所以不让调用方指定大小，只返回配置的大小
+	engine.GET("/payload", func(context *gin.Context) {
+		context.DataFromReader(http.StatusOK, int64(throughputSize), "application/octet-stream", io.LimitReader(payloadReader{}, int64(throughputSize)), map[string]string{})
+	})
+	engine.GET("/target", func(context *gin.Context) {
+		context.JSON(http.StatusOK, createResponseData(listTargetStatus(), nil))
+	})
+	engine.GET("/worker", func(context *gin.Context) {
+		context.JSON(http.StatusOK, createResponseData(listCheckStageStatus(), nil))
+	})
+	engine.POST("/worker", checkAdmin, func(context *gin.Context) {
+		stage := context.PostForm("stage")
+		size, err := strconv.Atoi(context.PostForm("size"))
+		log.WithFields(logrus.Fields{"stage": stage, "size": size}).Info("手动调整验证阶段worker数量")
+		if err == nil {
+			err = resizeCheckStage(stage, size)
+		}
+		context.JSON(http.StatusOK, createResponseData(listCheckStageStatus(), err))
+	})
+	engine.GET("/source", func(context *gin.Context) {
+		context.JSON(http.StatusOK, createResponseData(listSources(), nil))
+	})
+	engine.POST("/source/enable", checkAdmin, func(context *gin.Context) {
+		name := context.PostForm("name")
+		log.WithFields(logrus.Fields{"name": name}).Info("手动启用代理源")
+		context.JSON(http.StatusOK, createResponseData(name, enableSource(name)))
+	})
+	server := &http.Server{Addr: address, Handler: engine}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.WithFields(logrus.Fields{"err": err}).Error("web服务异常")
+			stop()
+		}
+		log.Info("结束web服务")
+	}()
+	return server
+}
+
+//设置了LIST_TOKEN时，/list需要带上Authorization: Bearer <LIST_TOKEN>，供peer拉取时鉴权，ADMIN_TOKEN也可以
+func checkListToken(context *gin.Context) {
+	if listToken == "" || context.GetHeader("Authorization") == fmt.Sprintf("Bearer %s", listToken) || isAdmin(context) {
+		return
+	}
+	context.AbortWithStatusJSON(http.StatusUnauthorized, createResponseData(nil, errors.New("token错误")))
+}
+
+//只有设置了ADMIN_TOKEN并且带上Authorization: Bearer <ADMIN_TOKEN>才是管理员，能看到代理的认证信息
+func isAdmin(context *gin.Context) bool {
+	return adminToken != "" && context.GetHeader("Authorization") == fmt.Sprintf("Bearer %s", adminToken)
+}
+
+//修改运行状态的接口只允许管理员调用，没有设置ADMIN_TOKEN时都不能调用
+func checkAdmin(context *gin.Context) {
+	if isAdmin(context) {
+		return
+	}
+	context.AbortWithStatusJSON(http.StatusUnauthorized, createResponseData(nil, errors.New("需要管理员token")))
+}
+
+func createResponseData(data interface{}, err error) interface{} {
+	if err == nil {
+		return gin.H{"code": 1, "massage": err, "data": data}
+	} else {
+		return gin.H{"code": 2, "massage": err, "data": data}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+func (proxy *Proxy) Url() string {
+	return proxy.urlFor(proxy.Protocol)
+}
+
+//带上认证信息的代理链接，用于实际请求
+func (proxy *Proxy) urlFor(protocol string) string {
+	proxyUrl := url.URL{Scheme: protocol, Host: proxy.Address}
+	if proxy.Username != "" || proxy.Password != "" {
+		proxyUrl.User = url.UserPassword(proxy.Username, proxy.Password)
+	}
+	return proxyUrl.String()
+}
+
+//隐藏认证信息，用于日志和列表
+func (proxy *Proxy) redacted() *Proxy {
+	redacted := proxy.clone()
+	if redacted.Username != "" || redacted.Password != "" {
+		redacted.Username = redactedCredential
+		redacted.Password = redactedCredential
+	}
+	return redacted
+}
+
+const redactedCredential = "******"
+
+//隐藏代理链接里的认证信息，解析失败时整个隐藏
+func redactProxyUrl(proxy string) string {
+	proxyUrl, err := url.Parse(proxy)
+	if err != nil {
+		return redactedCredential
+	}
+	if proxyUrl.User == nil {
+		return proxyUrl.String()
+	}
+	//url.UserPassword会把*转义，直接拼接更容易看
+	proxyUrl.User = nil
+	return strings.Replace(proxyUrl.String(), "://", fmt.Sprintf("://%s:%s@", redactedCredential, redactedCredential), 1)
+}
+
+func (proxy *Proxy) clone() *Proxy {
+	clone := *proxy
+	clone.Sources = append([]string{}, proxy.Sources...)
+	clone.Protocols = append([]string{}, proxy.Protocols...)
+	clone.Timings = append([]Timing{}, proxy.Timings...)
+	clone.Capabilities = append([]string{}, proxy.Capabilities...)
+	clone.Profiles = make(map[string]bool, len(proxy.Profiles))
+	for name := range proxy.Profiles {
+		clone.Profiles[name] = proxy.Profiles[name]
+	}
+	return &clone
+}
+
+func (proxy *Proxy) addSource(source string) {
+	if source == "" {
+		return
+	}
+	for i := range proxy.Sources {
+		if proxy.Sources[i] == source {
+			return
+		}
+	}
+	proxy.Sources = append(proxy.Sources, source)
+}
+
+//兼容旧的"http://host:port"和"host:port"写法，认证信息写成"user:pass@host:port"
+func parseProxy(proxyString string) *Proxy {
+	proxyString = strings.TrimSpace(proxyString)
+	if proxyString == "" {
+		return nil
+	}
+	proxy := &Proxy{Protocol: "http", Address: proxyString, FirstSeen: time.Now()}
+	if index := strings.Index(proxyString, "://"); index >= 0 {
+		proxy.Address = proxyString[index+3:]
+		if index > 0 {
+			proxy.Protocol = proxyString[:index]
+		}
+	}
+	if index := strings.LastIndex(proxy.Address, "@"); index >= 0 {
+		userinfo := proxy.Address[:index]
+		proxy.Address = proxy.Address[index+1:]
+		proxy.Username = userinfo
+		if colon := strings.Index(userinfo, ":"); colon >= 0 {
+			proxy.Username, proxy.Password = userinfo[:colon], userinfo[colon+1:]
+		}
+		if username, err := url.PathUnescape(proxy.Username); err == nil {
+			proxy.Username = username
+		}
+		if password, err := url.PathUnescape(proxy.Password); err == nil {
+			proxy.Password = password
+		}
+	}
+	proxy.Protocols = []string{proxy.Protocol}
+	return proxy
+}
+
+//Anonymity是最低匿名等级，例如anonymous也会返回elite的代理；MaxLatency按延迟EWMA过滤，单位毫秒
+type ProxyFilter struct {
+	Protocol   string
+	Capability string
+	Profile    string
+	Anonymity  string
+	MaxLatency int64
+	MinScore   float64
+	//每个出口ip只算一个代理
+	UniqueExit bool
+	//默认排除篡改内容的代理
+	Tampered bool
+	//Country是ISO国家代码，City不区分大小写，Org按子串匹配
+	Country string
+	City    string
+	Asn     uint
+	Org     string
+	IpType  string
+	//最低带宽，单位KB/s
+	MinThroughput float64
+}
+
+func parseProxyFilter(context *gin.Context) ProxyFilter {
+	maxLatency, _ := strconv.ParseInt(context.Query("maxLatency"), 10, 64)
+	minScore, _ := strconv.ParseFloat(context.Query("minScore"), 64)
+	minThroughput, _ := strconv.ParseFloat(context.Query("minThroughput"), 64)
+	asn, _ := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(context.Query("asn")), "AS"), 10, 32)
+	return ProxyFilter{
+		Protocol:      context.Query("protocol"),
+		Capability:    context.Query("capability"),
+		Profile:       context.Query("profile"),
+		Anonymity:     context.Query("anonymity"),
+		MaxLatency:    maxLatency,
+		MinScore:      minScore,
+		UniqueExit:    context.Query("uniqueExit") == "true",
+		Tampered:      context.Query("tampered") == "true",
+		Country:       context.Query("country"),
+		City:          context.Query("city"),
+		Asn:           uint(asn),
+		Org:           context.Query("org"),
+		IpType:        context.Query("ipType"),
+		MinThroughput: minThroughput,
+	}
+}
+
+func (filter ProxyFilter) match(proxy *Proxy) bool {
+	if filter.Protocol != "" && !containsString(proxy.Protocols, filter.Protocol) {
+		return false
+	}
+	if filter.Capability != "" && !containsString(proxy.Capabilities, filter.Capability) {
+		return false
+	}
+	if filter.Profile != "" && !proxy.Profiles[filter.Profile] {
+		return false
+	}
+	if filter.Anonymity != "" && anonymityLevel(proxy.Anonymity) < anonymityLevel(filter.Anonymity) {
+		return false
+	}
+	if filter.MaxLatency > 0 && (proxy.LatencyEwma <= 0 || proxy.LatencyEwma > time.Duration(filter.MaxLatency)*time.Millisecond) {
+		return false
+	}
+	if filter.MinScore > 0 && proxy.Score < filter.MinScore {
+		return false
+	}
+	if proxy.Tampered && !filter.Tampered {
+		return false
+	}
+	if filter.Country != "" && !strings.EqualFold(proxy.Country, filter.Country) {
+		return false
+	}
+	if filter.City != "" && !strings.EqualFold(proxy.City, filter.City) {
+		return false
+	}
+	if filter.Asn != 0 && proxy.Asn != filter.Asn {
+		return false
+	}
+	if filter.Org != "" && !strings.Contains(strings.ToLower(proxy.Org), strings.ToLower(filter.Org)) {
+		return false
+	}
+	if filter.IpType != "" && proxy.IpType != filter.IpType {
+		return false
+	}
+	if filter.MinThroughput > 0 && proxy.Throughput < filter.MinThroughput {
+		return false
+	}
+	return true
+}
+
+func containsString(values []string, s string) bool {
+	for i := range values {
+		if values[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+//指定了协议时，返回的代理以该协议作为默认协议
+//UniqueExit时先随机选出口ip再从中随机选代理，共用出口的代理不会被选中得更多
+func getProxy(filter ProxyFilter) *Proxy {
+	globalProxiesLock.Lock()
+	defer globalProxiesLock.Unlock()
+	var proxies []*Proxy
+	for i := range globalProxies {
+		if filter.match(globalProxies[i]) {
+			proxies = append(proxies, globalProxies[i])
+		}
+	}
+	if len(proxies) == 0 {
+		return nil
+	}
+	if filter.UniqueExit {
+		groups := groupProxiesByExit(proxies)
+		exits := make([]string, 0, len(groups))
+		for exit := range groups {
+			exits = append(exits, exit)
+		}
+		sort.Strings(exits)
+		proxies = groups[exits[rand.Intn(len(exits))]]
+	}
+	proxy := proxies[rand.Intn(len(proxies))].clone()
+	if filter.Protocol != "" {
+		proxy.Protocol = filter.Protocol
+	}
+	return proxy
+}
+
+func getProxyUrl() string {
+	proxy := getProxy(ProxyFilter{})
+	if proxy == nil {
+		return ""
+	}
+	return proxy.Url()
+}
+
+//没有测过延迟的代理排在最后
+func sortProxiesByLatency(proxies []*Proxy) {
+	sort.SliceStable(proxies, func(i, j int) bool {
+		if proxies[i].LatencyEwma <= 0 || proxies[j].LatencyEwma <= 0 {
+			return proxies[i].LatencyEwma > 0
+		}
+		return proxies[i].LatencyEwma < proxies[j].LatencyEwma
+	})
+}
+
+//UniqueExit时每个出口ip只保留分数最高的代理
+func listProxies(filter ProxyFilter) []*Proxy {
+	globalProxiesLock.Lock()
+	defer globalProxiesLock.Unlock()
+	proxies := make([]*Proxy, 0, len(globalProxies))
+	best := make(map[string]int)
+	for i := range globalProxies {
+		if !filter.match(globalProxies[i]) {
+			continue
+		}
+		if filter.UniqueExit {
+			exit := globalProxies[i].exitKey()
+			if index, ok := best[exit]; ok {
+				if globalProxies[i].Score > proxies[index].Score {
+					proxies[index] = globalProxies[i].clone()
+				}
+				continue
+			}
+			best[exit] = len(proxies)
+		}
+		proxies = append(proxies, globalProxies[i].clone())
+	}
+	return proxies
+}
+
+//还没测出出口ip的代理单独算一组
+func (proxy *Proxy) exitKey() string {
+	if proxy.ExitIp == "" {
+		return proxy.Address
+	}
+	return proxy.ExitIp
+}
+
+func groupProxiesByExit(proxies []*Proxy) map[string][]*Proxy {
+	groups := make(map[string][]*Proxy)
+	for i := range proxies {
+		exit := proxies[i].exitKey()
+		groups[exit] = append(groups[exit], proxies[i])
+	}
+	return groups
+}
+
+//出口ip对应的代理地址，只包含已测出出口ip的代理
+func listExitGroups() map[string][]string {
+	globalProxiesLock.Lock()
+	defer globalProxiesLock.Unlock()
+	groups := make(map[string][]string)
+	for i := range globalProxies {
+		if globalProxies[i].ExitIp == "" {
+			continue
+		}
+		groups[globalProxies[i].ExitIp] = append(groups[globalProxies[i].ExitIp], globalProxies[i].Address)
+	}
+	return groups
+}
+
+//proxy是一次验证通过的结果，已在池中的代理只更新检查结果、提高分数并合并来源
+func addProxy(proxy *Proxy, source string) {
+	globalProxiesLock.Lock()
+	defer globalProxiesLock.Unlock()
+	if proxy == nil || proxy.Address == "" {
+		return
+	}
+	if exist, ok := globalProxiesMap[proxy.Address]; ok {
+		exist.Protocol = proxy.Protocol
+		exist.Protocols = proxy.Protocols
+		//只覆盖这次验证有结果的方案，目标不可用的方案保留上次的结果
+		if exist.Profiles == nil {
+			exist.Profiles = make(map[string]bool, len(proxy.Profiles))
+		}
+		for name := range proxy.Profiles {
+			exist.Profiles[name] = proxy.Profiles[name]
+		}
+		exist.Anonymity = proxy.Anonymity
+		exist.Tampered = proxy.Tampered
+		if proxy.Username != "" || proxy.Password != "" {
+			exist.Username = proxy.Username
+			exist.Password = proxy.Password
+		}
+		if proxy.Country != "" || proxy.Asn != 0 {
+			exist.Country, exist.City, exist.Asn, exist.Org = proxy.Country, proxy.City, proxy.Asn, proxy.Org
+		}
+		if proxy.IpType != "" {
+			exist.IpType = proxy.IpType
+		}
+		//这次做了带宽测试就覆盖，下载失败的代理不能保留旧的速度
+		if !proxy.ThroughputChecked.IsZero() {
+			exist.Throughput = proxy.Throughput
+			exist.ThroughputChecked = proxy.ThroughputChecked
+		}
+		if proxy.Capabilities != nil {
+			exist.Capabilities = proxy.Capabilities
+		}
+		if proxy.ExitIp != "" {
+			exist.ExitIp = proxy.ExitIp
+		}
+		if len(proxy.Timings) > 0 {
+			exist.addTiming(proxy.Timings[len(proxy.Timings)-1])
+		}
+		exist.LastChecked = proxy.LastChecked
+		exist.NextCheck = proxy.LastChecked.Add(recheckInterval)
+		exist.FailCount = 0
+		exist.Score = scoreEwmaAlpha + (1-scoreEwmaAlpha)*exist.Score
+		exist.addSource(source)
+		return
+	}
+	proxy.NextCheck = proxy.LastChecked.Add(recheckInterval)
+	proxy.Score = 1
+	proxy.addSource(source)
+	globalProxiesMap[proxy.Address] = proxy
+	globalProxies = append(globalProxies, proxy)
+}
+
+//池中的代理验证失败时降低分数，分数低于scoreMin才移出代理池，返回代理是否还在池中
+func failProxy(address string) bool {
+	globalProxiesLock.Lock()
+	defer globalProxiesLock.Unlock()
+	exist, ok := globalProxiesMap[address]
+	if !ok {
+		return false
+	}
+	exist.LastChecked = time.Now()
+	exist.NextCheck = exist.LastChecked.Add(recheckInterval)
+	exist.FailCount++
+	exist.Score = (1 - scoreEwmaAlpha) * exist.Score
+	if exist.Score >= scoreMin {
+		return true
+	}
+	log.WithFields(logrus.Fields{"address": address, "score": exist.Score, "failCount": exist.FailCount}).Info("代理分数过低，移出代理池")
+	removeProxyLocked(address)
+	return false
+}
+
+func removeProxy(address string) {
+	globalProxiesLock.Lock()
+	defer globalProxiesLock.Unlock()
+	removeProxyLocked(address)
+}
+
+//调用方需要持有globalProxiesLock
+func removeProxyLocked(address string) {
+	exist, ok := globalProxiesMap[address]
+	if !ok {
+		return
+	}
+	delete(globalProxiesMap, address)
+	for i := range globalProxies {
+		if globalProxies[i] == exist {
+			globalProxies = append(globalProxies[:i], globalProxies[i+1:]...)
+			break
+		}
+	}
+}
+
+func addProxies(proxies []*Proxy) {
+	globalProxiesLock.Lock()
+	defer globalProxiesLock.Unlock()
+	if proxies == nil || len(proxies) == 0 {
+		return
+	}
+	for i := range proxies {
+		if proxies[i] == nil || proxies[i].Address == "" {
+			continue
+		}
+		if _, ok := globalProxiesMap[proxies[i].Address]; ok {
+			continue
+		}
+		globalProxiesMap[proxies[i].Address] = proxies[i]
+		globalProxies = append(globalProxies, proxies[i])
+	}
+}
+
+//取出到了复查时间的代理地址，并把它们的下次复查时间往后推，避免结果回来前被重复取出
+func takeRecheckProxies(now time.Time) []string {
+	globalProxiesLock.Lock()
+	defer globalProxiesLock.Unlock()
+	var proxies []string
+	for i := range globalProxies {
+		if globalProxies[i].NextCheck.After(now) {
+			continue
+		}
+		globalProxies[i].NextCheck = now.Add(recheckInterval)
+		//带上认证信息，否则需要认证的代理复查一定失败
+		proxies = append(proxies, globalProxies[i].Url())
+	}
+	return proxies
+}
+
+func loadGlobalProxies() error {
+	jsonString, err := readFileOrCreateIfNotExist(dataPath, "[]")
+	if err != nil {
+		return err
+	}
+	return addProxyByJson(jsonString)
+}
+
+//支持Proxy对象数组，也支持旧的代理链接字符串数组
+func addProxyByJson(jsonString string) error {
+	var proxies []*Proxy
+	err := json.Unmarshal([]byte(jsonString), &proxies)
+	if err != nil {
+		var proxyStrings []string
+		if json.Unmarshal([]byte(jsonString), &proxyStrings) != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("反序列化代理数据json失败")
+			return err
+		}
+		proxies = nil
+		for i := range proxyStrings {
+			if proxy := parseProxy(proxyStrings[i]); proxy != nil {
+				proxies = append(proxies, proxy)
+			}
+		}
+	}
+	for i := range proxies {
+		if proxies[i] != nil && proxies[i].FirstSeen.IsZero() {
+			proxies[i].FirstSeen = time.Now()
+		}
+		if proxies[i] != nil && proxies[i].Protocol == "" {
+			proxies[i].Protocol = "http"
+		}
+		if proxies[i] != nil && len(proxies[i].Protocols) == 0 {
+			proxies[i].Protocols = []string{proxies[i].Protocol}
+		}
+		if proxies[i] != nil && proxies[i].Score <= 0 {
+			proxies[i].Score = 1
+		}
+	}
+	log.WithFields(logrus.Fields{"count": len(proxies)}).Info("反序列化代理数据json成功")
+	var allowed []*Proxy
+	for i := range proxies {
+		if proxies[i] == nil {
+			continue
+		}
+		if ip, reason := checkProxyRules(proxies[i]); reason != "" {
+			log.WithFields(logrus.Fields{"address": proxies[i].Address, "ip": ip, "rule": reason}).Warn("代理被访问规则拒绝")
+			continue
+		}
+		allowed = append(allowed, proxies[i])
+	}
+	addProxies(allowed)
+	return nil
+}
+
+func saveGlobalProxies() error {
+	bytes, err := json.Marshal(listProxies(ProxyFilter{}))
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("序列化globalProxies失败")
+		return err
+	}
+	err = writeFileOrCreateIfNotExist(dataPath, bytes)
+	return err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+func writeFileOrCreateIfNotExist(filePath string, text []byte) error {
+	_, err := os.Stat(filePath)
+	if err == nil || os.IsExist(err) {
+		err = ioutil.WriteFile(filePath, text, 0644)
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("写入文件失败")
+		}
+		return err
+	}
+	return createFile(filePath, text)
+}
+
+func readFileOrCreateIfNotExist(filePath string, defaultText string) (string, error) {
+	_, err := os.Stat(filePath)
+	if err == nil || os.IsExist(err) {
+		bytes, err := readFile(filePath)
+		if err != nil {
+			return "", err
+		}
+		text := string(bytes)
+		//文件里可能有代理认证信息或peer的token，只记录长度
+		log.WithFields(logrus.Fields{"filePath": filePath, "length": len(text)}).Info("读取文件文本")
+		return text, err
+	}
+	err = createFile(filePath, []byte(defaultText))
+	return defaultText, err
+}
+
+func createFile(filePath string, defaultData []byte) error {
+	folderPath, _ := path.Split(filePath)
+	log.WithFields(logrus.Fields{"folderPath": folderPath}).Info("文件父文件夹")
+	if folderPath != "" {
+		err := os.MkdirAll(folderPath, 0666)
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("创建父文件夹失败")
+			return err
+		}
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("创建文件失败")
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(defaultData)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("写入文件初始文本失败")
+	}
+	return err
+}
+
+func readFile(filePath string) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("打开文件失败")
+		return nil, err
+	}
+	defer file.Close()
+	bytes, err := ioutil.ReadAll(file)
+	if err != nil {
+		log.Error("读取文件失败")
+		return nil, err
+	}
+	return bytes, err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//代理源都在暂停或等待时，每个周期之间至少间隔flushInterval，避免空转
+func autoFlushProxy(ctx context.Context) {
+	for ctx.Err() == nil {
+		flushProxy(ctx)
+		sleepContext(ctx, flushInterval)
+	}
+}
+
+func flushProxy(ctx context.Context) {
+	updateSourceStats()
+	fetchSources(ctx)
+	saveGlobalProxies()
+}
+
+//代理在池中按各自的复查时间重新验证，不再清空代理池
+func autoRecheckProxy(ctx context.Context) {
+	for ctx.Err() == nil {
+		recheckProxies(ctx, takeRecheckProxies(time.Now()))
+		sleepContext(ctx, recheckTick)
+	}
+}
+
+//复查池中原有的代理，source为空，不计入代理源统计
+func recheckProxies(ctx context.Context, proxies []string) {
+	for i := range proxies {
+		submitCandidate(ctx, candidate{proxy: proxies[i], trust: trustNone})
+	}
+}
+
+func checkProxiesWithTrust(ctx context.Context, source string, trust string, proxies []string) {
+	for i := range proxies {
+		submitCandidate(ctx, candidate{proxy: proxies[i], source: source, trust: trust})
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//验证分成几个阶段：TCP连接、协议握手、验证目标、附加检查（匿名等级等），每个阶段有自己的队列和worker数量，
+//大部分失效的候选代理在代价最小的TCP阶段就被丢掉
+type checkJob struct {
+	candidate candidate
+	proxy     *Proxy
+	protocols []string
+	timing    Timing
+	//验证目标不可用导致的失败，不算代理失败
+	targetDown bool
+	//本机原因导致的失败，比如文件句柄或端口用完
+	localFailure bool
+}
+
+//worker数量可以在运行时调整，缩小时多出来的worker处理完手上的job后退出
+type checkStage struct {
+	name string
+	ctx  context.Context
+	jobs chan *checkJob
+	//返回false表示验证失败，不再进入下一阶段
+	run  func(ctx context.Context, job *checkJob) bool
+	next *checkStage
+
+	lock    sync.Mutex
+	size    int
+	workers int
+	active  int
+	//缩小时关闭，唤醒空闲的worker检查自己是否该退出
+	shrink chan struct{}
+	//自动伸缩统计周期内处理的job数和本机原因失败的job数，代理本身不可用不算
+	processed   int
+	localFailed int
+	minSize     int
+	maxSize     int
+}
+
+type CheckStageStatus struct {
+	Name    string `json:"name"`
+	Size    int    `json:"size"`
+	Workers int    `json:"workers"`
+	Active  int    `json:"active"`
+	Idle    int    `json:"idle"`
+	Queued  int    `json:"queued"`
+	MinSize int    `json:"minSize"`
+	MaxSize int    `json:"maxSize"`
+}
+
+var tcpStage *checkStage
+var handshakeStage *checkStage
+var targetStage *checkStage
+var extraStage *checkStage
+var throughputStage *checkStage
+
+//ctx取消后各阶段的worker处理完手上的job就退出
+//配置了带宽测试地址时，在最后加一个带宽测试阶段
+func startCheckStages(ctx context.Context, tcpCount int, handshakeCount int, targetCount int, extraCount int, throughputCount int) {
+	if throughputUrl != "" {
+		throughputStage = newCheckStage(ctx, "throughput", throughputCount, runThroughputStage, nil)
+	}
+	extraStage = newCheckStage(ctx, "extra", extraCount, runExtraStage, throughputStage)
+	targetStage = newCheckStage(ctx, "target", targetCount, runTargetStage, extraStage)
+	handshakeStage = newCheckStage(ctx, "handshake", handshakeCount, runHandshakeStage, targetStage)
+	tcpStage = newCheckStage(ctx, "tcp", tcpCount, runTcpStage, handshakeStage)
+}
+
+func checkStages() []*checkStage {
+	if throughputStage == nil {
+		return []*checkStage{tcpStage, handshakeStage, targetStage, extraStage}
+	}
+	return []*checkStage{tcpStage, handshakeStage, targetStage, extraStage, throughputStage}
+}
+
+func findCheckStage(name string) *checkStage {
+	stages := checkStages()
+	for i := range stages {
+		if stages[i].name == name {
+			return stages[i]
+		}
+	}
+	return nil
+}
+
+//自动伸缩的范围是初始worker数量的1/4到4倍
+func newCheckStage(ctx context.Context, name string, count int, run func(ctx context.Context, job *checkJob) bool, next *checkStage) *checkStage {
+	stage := &checkStage{name: name, ctx: ctx, jobs: make(chan *checkJob, count), run: run, next: next, shrink: make(chan struct{})}
+	stage.minSize = count / 4
+	if stage.minSize < 1 {
+		stage.minSize = 1
+	}
+	stage.maxSize = count * 4
+	stage.resize(count)
+	return stage
+}
+
+func (stage *checkStage) resize(size int) {
+	stage.lock.Lock()
+	defer stage.lock.Unlock()
+	if size < 1 {
+		size = 1
+	}
+	log.WithFields(logrus.Fields{"stage": stage.name, "from": stage.size, "to": size}).Info("调整验证阶段worker数量")
+	if size < stage.size {
+		close(stage.shrink)
+		stage.shrink = make(chan struct{})
+	}
+	stage.size = size
+	for ; stage.workers < stage.size; stage.workers++ {
+		serviceWaitGroup.Add(1)
+		go stage.work()
+	}
+}
+
+func (stage *checkStage) exitIfOversize() bool {
+	stage.lock.Lock()
+	defer stage.lock.Unlock()
+	if stage.workers <= stage.size {
+		return false
+	}
+	stage.workers--
+	return true
+}
+
+func (stage *checkStage) work() {
+	defer serviceWaitGroup.Done()
+	for {
+		stage.lock.Lock()
+		shrink := stage.shrink
+		stage.lock.Unlock()
+		select {
+		case job := <-stage.jobs:
+			stage.handle(job)
+		case <-shrink:
+		case <-stage.ctx.Done():
+			stage.lock.Lock()
+			stage.workers--
+			stage.lock.Unlock()
+			return
+		}
+		if stage.exitIfOversize() {
+			return
+		}
+	}
+}
+
+func (stage *checkStage) handle(job *checkJob) {
+	stage.lock.Lock()
+	stage.active++
+	stage.lock.Unlock()
+	ok := stage.run(stage.ctx, job)
+	stage.lock.Lock()
+	stage.active--
+	stage.processed++
+	if !ok && (job.localFailure || job.targetDown) {
+		stage.localFailed++
+	}
+	stage.lock.Unlock()
+
+	//服务停止导致的失败不能算代理失效
+	if stage.ctx.Err() != nil {
+		return
+	}
+	if !ok && job.targetDown {
+		log.WithFields(logrus.Fields{"address": job.proxy.Address, "stage": stage.name}).Warn("验证目标不可用，不算代理验证失败")
+		return
+	}
+	if !ok {
+		log.WithFields(logrus.Fields{"address": job.proxy.Address, "stage": stage.name}).Info("代理验证失败")
+		rejectJob(job)
+		return
+	}
+	if stage.next == nil {
+		acceptProxy(job.proxy, job.candidate.source, job.protocols, job.timing)
+		return
+	}
+	select {
+	case stage.next.jobs <- job:
+	case <-stage.ctx.Done():
+	}
+}
+
+func (stage *checkStage) status() CheckStageStatus {
+	stage.lock.Lock()
+	defer stage.lock.Unlock()
+	return CheckStageStatus{
+		Name:    stage.name,
+		Size:    stage.size,
+		Workers: stage.workers,
+		Active:  stage.active,
+		Idle:    stage.workers - stage.active,
+		Queued:  len(stage.jobs),
+		MinSize: stage.minSize,
+		MaxSize: stage.maxSize,
+	}
+}
+
+func listCheckStageStatus() []CheckStageStatus {
+	stages := checkStages()
+	var statuses []CheckStageStatus
+	for i := range stages {
+		statuses = append(statuses, stages[i].status())
+	}
+	return statuses
+}
+
+func resizeCheckStage(name string, size int) error {
+	stage := findCheckStage(name)
+	if stage == nil {
+		return errors.New("验证阶段不存在")
+	}
+	if size < 1 {
+		return errors.New("worker数量必须大于0")
+	}
+	stage.resize(size)
+	return nil
+}
+
+//队列积压时扩容，但本机原因的失败率很高时说明可能是本机出口有问题，不再扩容；队列空且一半以上worker空闲时缩容
+func autoScaleCheckStages(ctx context.Context) {
+	for sleepContext(ctx, autoScaleTick) {
+		stages := checkStages()
+		for i := range stages {
+			stages[i].autoScale()
+		}
+	}
+}
+
+func (stage *checkStage) autoScale() {
+	stage.lock.Lock()
+	size := stage.size
+	queued := len(stage.jobs)
+	idle := stage.workers - stage.active
+	failRate := 0.0
+	if stage.processed > 0 {
+		failRate = float64(stage.localFailed) / float64(stage.processed)
+	}
+	stage.processed = 0
+	stage.localFailed = 0
+	stage.lock.Unlock()
+
+	step := size / 4
+	if step < 1 {
+		step = 1
+	}
+	//队列容量固定是初始worker数量，扩容后size会超过容量，所以按队列是否塞满判断积压
+	if queued >= cap(stage.jobs) && failRate < autoScaleFailRateMax && size < stage.maxSize {
+		size += step
+		if size > stage.maxSize {
+			size = stage.maxSize
+		}
+		stage.resize(size)
+		return
+	}
+	if queued == 0 && idle*2 > size && size > stage.minSize {
+		size -= step
+		if size < stage.minSize {
+			size = stage.minSize
+		}
+		stage.resize(size)
+	}
+}
+
+//信任的候选直接入池，最近验证失败还没到重试时间的候选直接丢掉，其余进入TCP阶段
+func submitCandidate(ctx context.Context, candidate candidate) {
+	hint := parseProxy(candidate.proxy)
+	if hint == nil {
+		return
+	}
+	proxy := &Proxy{Address: hint.Address, Username: hint.Username, Password: hint.Password, FirstSeen: time.Now()}
+	if ip, reason := checkProxyRules(proxy); reason != "" {
+		log.WithFields(logrus.Fields{"address": proxy.Address, "ip": ip, "rule": reason, "source": candidate.source}).Warn("候选代理被访问规则拒绝")
+		return
+	}
+	if candidate.source != "" && isNegativeCached(proxy.Address, time.Now()) {
+		log.WithFields(logrus.Fields{"address": proxy.Address}).Info("候选代理最近验证失败，还没到重试时间，跳过")
+		return
+	}
+	if candidate.trust == trustFull {
+		log.WithFields(logrus.Fields{"proxy": redactProxyUrl(hint.Url()), "source": candidate.source}).Info("信任的代理源，跳过验证")
+		acceptProxy(proxy, candidate.source, []string{hint.Protocol}, Timing{})
+		return
+	}
+	protocols := checkProtocols
+	if candidate.trust == trustReduced {
+		protocols = []string{hint.Protocol}
+	}
+	select {
+	case tcpStage.jobs <- &checkJob{candidate: candidate, proxy: proxy, protocols: protocols}:
+	case <-ctx.Done():
+	}
+}
+
+func rejectJob(job *checkJob) {
+	if !failProxy(job.proxy.Address) {
+		addNegativeCache(job.proxy.Address, time.Now())
+	}
+}
+
+func runTcpStage(ctx context.Context, job *checkJob) bool {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", job.proxy.Address)
+	if err != nil {
+		log.WithFields(logrus.Fields{"address": job.proxy.Address, "err": err}).Info("代理TCP连接失败")
+		job.localFailure = isLocalNetError(err)
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+//本机资源不够或者没有网络导致的错误，和代理是否可用无关
+func isLocalNetError(err error) bool {
+	localErrors := []error{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.EADDRNOTAVAIL, syscall.ENETUNREACH, syscall.ENETDOWN}
+	for i := range localErrors {
+		if errors.Is(err, localErrors[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func runHandshakeStage(ctx context.Context, job *checkJob) bool {
+	job.protocols = sniffProtocols(ctx, job.proxy, job.protocols)
+	return len(job.protocols) > 0
+}
+
+//每个握手成功的协议并发验证，job.protocols只留下验证通过的协议
+func runTargetStage(ctx context.Context, job *checkJob) bool {
+	results := make([]checkResult, len(job.protocols))
+	var waitGroup sync.WaitGroup
+	for i := range job.protocols {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			proxyUrl := job.proxy.urlFor(job.protocols[i])
+			log.WithFields(logrus.Fields{"proxyUrl": redactProxyUrl(proxyUrl)}).Info("代理链接")
+			results[i] = checkProxy(ctx, proxyUrl)
+		}(i)
+	}
+	waitGroup.Wait()
+	var passedProtocols []string
+	var tamperedProtocols []string
+	failedCount, downCount := 0, 0
+	passedProfiles := make(map[string]bool)
+	for i := range results {
+		for name := range results[i].profiles {
+			passedProfiles[name] = passedProfiles[name] || results[i].profiles[name]
+		}
+		if results[i].tampered {
+			tamperedProtocols = append(tamperedProtocols, job.protocols[i])
+		}
+		if !results[i].ok {
+			failedCount++
+			if results[i].targetDown {
+				downCount++
+			}
+			continue
+		}
+		if len(passedProtocols) == 0 || results[i].timing.Total < job.timing.Total {
+			job.timing = results[i].timing
+		}
+		passedProtocols = append(passedProtocols, job.protocols[i])
+	}
+	job.proxy.Profiles = passedProfiles
+	job.proxy.Tampered = len(tamperedProtocols) > 0
+	job.targetDown = failedCount > 0 && downCount == failedCount
+	//篡改内容的代理也要入池并标记，/get默认会排除
+	if len(passedProtocols) == 0 {
+		passedProtocols = tamperedProtocols
+	}
+	job.protocols = passedProtocols
+	return len(passedProtocols) > 0
+}
+
+//附加检查主要补充代理信息，只有出口ip被访问规则拒绝时才让代理验证失败
+func runExtraStage(ctx context.Context, job *checkJob) bool {
+	job.proxy.Anonymity, job.proxy.ExitIp = checkAnonymity(ctx, job.proxy.urlFor(job.protocols[0]))
+	job.proxy.Capabilities = checkCapabilities(ctx, job.proxy, job.protocols)
+	enrichGeo(job.proxy)
+	if ip, reason := checkProxyRules(job.proxy); reason != "" {
+		log.WithFields(logrus.Fields{"address": job.proxy.Address, "ip": ip, "rule": reason}).Warn("代理出口被访问规则拒绝")
+		removeProxy(job.proxy.Address)
+		return false
+	}
+	return true
+}
+
+//带宽测试只记录结果，下载失败记为0，不会让代理验证失败；池中的代理距离上次测试不到throughputInterval时跳过，保留上次的结果
+func runThroughputStage(ctx context.Context, job *checkJob) bool {
+	if checked := throughputCheckedAt(job.proxy.Address); time.Since(checked) < throughputInterval {
+		log.WithFields(logrus.Fields{"address": job.proxy.Address, "checked": checked}).Info("代理最近做过带宽测试，跳过")
+		return true
+	}
+	throughput, err := measureThroughput(ctx, job.proxy.urlFor(job.protocols[0]), throughputUrl)
+	log.WithFields(logrus.Fields{"address": job.proxy.Address, "throughput": throughput, "err": err}).Info("代理带宽测试结果")
+	job.proxy.Throughput = throughput
+	job.proxy.ThroughputChecked = time.Now()
+	return true
+}
+
+func throughputCheckedAt(address string) time.Time {
+	globalProxiesLock.Lock()
+	defer globalProxiesLock.Unlock()
+	if exist, ok := globalProxiesMap[address]; ok {
+		return exist.ThroughputChecked
+	}
+	return time.Time{}
+}
+
+//通过代理下载测试数据，按收到响应头之后的下载速度计算，单位KB/s；超时前已经下载的部分也会计算
+func measureThroughput(ctx context.Context, proxy string, targetUrl string) (float64, error) {
+	transport, err := newProxyTransport(proxy)
+	if err != nil {
+		return 0, err
+	}
+	client := &http.Client{Transport: transport, Timeout: throughputTimeout}
+	request, err := http.NewRequest(http.MethodGet, targetUrl, nil)
+	if err != nil {
+		return 0, err
+	}
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("带宽测试响应码异常：%d", response.StatusCode)
+	}
+	start := time.Now()
+	size, err := io.Copy(ioutil.Discard, response.Body)
+	elapsed := time.Since(start)
+	if size == 0 || elapsed <= 0 {
+		return 0, err
+	}
+	return float64(size) / 1024 / elapsed.Seconds(), err
+}
+
+const (
+	capabilityPlain      = "plain"
+	capabilityConnect443 = "connect443"
+	capabilityConnectAny = "connect-any"
+	capabilitySocks4     = "socks4"
+	capabilitySocks4a    = "socks4a"
+	capabilitySocks5h    = "socks5h"
+)
+
+//http、https代理分别验证普通转发、CONNECT到443端口和CONNECT到其他端口；
+//socks4、socks4a以目标验证的结果为准，socks5额外验证能否由代理解析域名（socks5h），避免泄露DNS
+func checkCapabilities(ctx context.Context, proxy *Proxy, protocols []string) []string {
+	protocol := ""
+	for _, candidate := range []string{"http", "https"} {
+		if containsString(protocols, candidate) {
+			protocol = candidate
+			break
+		}
+	}
+	//没有配置测试地址的能力不做验证
+	var capabilities []string
+	if protocol != "" && plainCheckUrl != "" {
+		capabilities = append(capabilities, capabilityPlain)
+	}
+	if protocol != "" && connect443Address != "" {
+		capabilities = append(capabilities, capabilityConnect443)
+	}
+	if protocol != "" && connectAnyAddress != "" {
+		capabilities = append(capabilities, capabilityConnectAny)
+	}
+	if containsString(protocols, "socks5") && connect443Address != "" {
+		capabilities = append(capabilities, capabilitySocks5h)
+	}
+	passed := make([]bool, len(capabilities))
+	var waitGroup sync.WaitGroup
+	for i := range capabilities {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			passed[i] = checkCapability(ctx, protocol, proxy, capabilities[i])
+		}(i)
+	}
+	waitGroup.Wait()
+	result := []string{}
+	for i := range capabilities {
+		if passed[i] {
+			result = append(result, capabilities[i])
+		}
+	}
+	for _, capability := range []string{capabilitySocks4, capabilitySocks4a} {
+		if containsString(protocols, capability) {
+			result = append(result, capability)
+		}
+	}
+	log.WithFields(logrus.Fields{"address": proxy.Address, "capabilities": result}).Info("代理转发能力验证结果")
+	return result
+}
+
+//没有用环境变量配置时，优先用judge：http的judge链接作为普通转发的测试地址，judge的端口不是443时作为CONNECT到其他端口的测试地址；
+//再从验证目标里找http链接作为普通转发的测试地址，找https的443端口作为CONNECT的测试地址
+func deriveCapabilityTargets() {
+	if judge, err := url.Parse(judgeUrl); judgeUrl != "" && err == nil {
+		if plainCheckUrl == "" && judge.Scheme == "http" {
+			plainCheckUrl = judgeUrl
+		}
+		port := judge.Port()
+		if port == "" && judge.Scheme == "http" {
+			port = "80"
+		}
+		if connectAnyAddress == "" && port != "" && port != "443" {
+			connectAnyAddress = net.JoinHostPort(judge.Hostname(), port)
+		}
+	}
+	profiles := getCheckProfiles()
+	for i := range profiles {
+		for j := range profiles[i].Targets {
+			targetUrl, err := url.Parse(profiles[i].Targets[j].Url)
+			if err != nil {
+				continue
+			}
+			if plainCheckUrl == "" && targetUrl.Scheme == "http" {
+				plainCheckUrl = targetUrl.String()
+			}
+			if connect443Address == "" && targetUrl.Scheme == "https" && (targetUrl.Port() == "" || targetUrl.Port() == "443") {
+				connect443Address = net.JoinHostPort(targetUrl.Hostname(), "443")
+			}
+		}
+	}
+	log.WithFields(logrus.Fields{"plain": plainCheckUrl, "connect443": connect443Address, "connectAny": connectAnyAddress}).Info("代理转发能力的测试地址")
+	if plainCheckUrl == "" {
+		log.WithFields(logrus.Fields{"capability": capabilityPlain}).Warn("没有测试地址，不验证该转发能力，可以配置PLAIN_CHECK_URL或http的JUDGE_URL")
+	}
+	if connect443Address == "" {
+		log.WithFields(logrus.Fields{"capability": []string{capabilityConnect443, capabilitySocks5h}}).Warn("没有测试地址，不验证该转发能力，可以配置CONNECT_443_ADDRESS")
+	}
+	if connectAnyAddress == "" {
+		log.WithFields(logrus.Fields{"capability": capabilityConnectAny}).Warn("没有测试地址，不验证该转发能力，可以配置CONNECT_ANY_ADDRESS或端口不是443的JUDGE_URL")
+	}
+}
+
+func checkCapability(ctx context.Context, protocol string, proxy *Proxy, capability string) bool {
+	switch capability {
+	case capabilityPlain:
+		response, _, _, err := requestThroughProxy(ctx, proxy.urlFor(protocol), "GET", plainCheckUrl, nil)
+		return err == nil && response.StatusCode < 400
+	case capabilityConnect443:
+		return checkConnect(ctx, protocol, proxy, connect443Address)
+	case capabilityConnectAny:
+		return checkConnect(ctx, protocol, proxy, connectAnyAddress)
+	case capabilitySocks5h:
+		return checkSocks5Remote(ctx, proxy, connect443Address)
+	}
+	return false
+}
+
+//用域名类型的地址发socks5 CONNECT，代理自己解析域名并连上才算通过
+func checkSocks5Remote(ctx context.Context, proxy *Proxy, target string) bool {
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || len(host) > 255 {
+		return false
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", proxy.Address)
+	if err != nil {
+		return false
+	}
+	defer closeOnDone(ctx, conn)()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if socks5Handshake(conn, proxy.Username, proxy.Password) != nil {
+		return false
+	}
+	request := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	request = append(request, host...)
+	request = append(request, byte(port>>8), byte(port))
+	if _, err = conn.Write(request); err != nil {
+		return false
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	return err == nil && reply[0] == 0x05 && reply[1] == 0x00
+}
+
+//socks4a用0.0.0.1作为ip，把域名放在userid后面交给代理解析；socks4只能带ip。socks4没有密码，只带userid
+func socks4Request(host string, port int, remote bool, ip net.IP, userId string) []byte {
+	request := []byte{0x04, 0x01, byte(port >> 8), byte(port)}
+	if remote {
+		request = append(request, 0x00, 0x00, 0x00, 0x01)
+		request = append(request, userId...)
+		request = append(request, 0x00)
+		request = append(request, host...)
+		return append(request, 0x00)
+	}
+	request = append(request, ip.To4()...)
+	request = append(request, userId...)
+	return append(request, 0x00)
+}
+
+//有认证信息时同时提供无认证和用户名密码两种方式，代理选了用户名密码就按RFC 1929认证
+func socks5Handshake(conn net.Conn, username string, password string) error {
+	greeting := []byte{0x05, 0x01, 0x00}
+	if username != "" || password != "" {
+		greeting = []byte{0x05, 0x02, 0x00, 0x02}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return errors.New("不是socks5代理")
+	}
+	switch reply[1] {
+	case 0x00:
+		return nil
+	case 0x02:
+		if len(greeting) == 3 || len(username) > 255 || len(password) > 255 {
+			return errors.New("socks5代理要求认证")
+		}
+		request := []byte{0x01, byte(len(username))}
+		request = append(request, username...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5代理认证失败")
+		}
+		return nil
+	}
+	return errors.New("socks5代理不支持的认证方式")
+}
+
+//net/http不支持socks4，自己实现拨号，socks4在本地解析域名，socks4a交给代理解析
+func socks4DialContext(proxyAddress string, remote bool, userId string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, portString, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return nil, err
+		}
+		var ip net.IP
+		if !remote {
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for i := range addrs {
+				if addrs[i].IP.To4() != nil {
+					ip = addrs[i].IP
+					break
+				}
+			}
+			if ip == nil {
+				return nil, errors.New("socks4只支持ipv4地址")
+			}
+		}
+		dialer := &net.Dialer{Timeout: timeout}
+		conn, err := dialer.DialContext(ctx, "tcp", proxyAddress)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(timeout))
+		reply := make([]byte, 8)
+		_, err = conn.Write(socks4Request(host, port, remote, ip, userId))
+		if err == nil {
+			_, err = io.ReadFull(conn, reply)
+		}
+		if err == nil && reply[1] != 0x5a {
+			err = fmt.Errorf("socks4代理拒绝连接，状态码%#x", reply[1])
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+//在代理上发CONNECT，代理返回2xx就算能建立隧道
+func checkConnect(ctx context.Context, protocol string, proxy *Proxy, target string) bool {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", proxy.Address)
+	if err != nil {
+		return false
+	}
+	defer closeOnDone(ctx, conn)()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if protocol == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		if tlsConn.Handshake() != nil {
+			return false
+		}
+		conn = tlsConn
+	}
+	authorization := ""
+	if proxy.Username != "" || proxy.Password != "" {
+		credential := base64.StdEncoding.EncodeToString([]byte(proxy.Username + ":" + proxy.Password))
+		authorization = fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", credential)
+	}
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", target, target, authorization)
+	if err != nil {
+		return false
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return false
+	}
+	response.Body.Close()
+	return response.StatusCode >= 200 && response.StatusCode < 300
+}
+
+type checkResult struct {
+	timing     Timing
+	profiles   map[string]bool
+	tampered   bool
+	targetDown bool
+	ok         bool
+}
+
+//ctx取消时关闭连接，打断阻塞中的读写；返回的函数用于正常结束时关闭连接
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		conn.Close()
+	}
+}
+
+//在原始TCP连接上并发探测各协议的握手，只返回握手成功的协议
+//有协议握手成功后，其他协议最多再等sniffGrace，同一端口支持多种协议的代理很快就会回应，
+//不支持的协议（比如http代理收到socks5握手）一般不回应，不用等到超时
+func sniffProtocols(ctx context.Context, proxy *Proxy, protocols []string) []string {
+	sniffCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var graceOnce sync.Once
+	sniffed := make([]bool, len(protocols))
+	var waitGroup sync.WaitGroup
+	for i := range protocols {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			sniffed[i] = sniffProtocol(sniffCtx, proxy, protocols[i])
+			if sniffed[i] {
+				graceOnce.Do(func() {
+					time.AfterFunc(sniffGrace, cancel)
+				})
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+	var result []string
+	for i := range protocols {
+		if sniffed[i] {
+			result = append(result, protocols[i])
+		}
+	}
+	log.WithFields(logrus.Fields{"address": proxy.Address, "protocols": result}).Info("代理握手探测结果")
+	return result
+}
+
+//不认识的协议不做探测，交给完整验证
+func sniffProtocol(ctx context.Context, proxy *Proxy, protocol string) bool {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", proxy.Address)
+	if err != nil {
+		return false
+	}
+	defer closeOnDone(ctx, conn)()
+	conn.SetDeadline(time.Now().Add(timeout))
+	switch protocol {
+	case "http":
+		_, err = conn.Write([]byte("HEAD http://www.example.com/ HTTP/1.0\r\nHost: www.example.com\r\n\r\n"))
+		if err != nil {
+			return false
+		}
+		reply := make([]byte, 5)
+		_, err = io.ReadFull(conn, reply)
+		return err == nil && string(reply) == "HTTP/"
+	case "socks5":
+		return socks5Handshake(conn, proxy.Username, proxy.Password) == nil
+	case "socks4", "socks4a":
+		//用socks4a的请求探测，只支持socks4的代理会拒绝，但回复的格式一样
+		_, err = conn.Write(socks4Request("www.example.com", 80, true, nil, proxy.Username))
+		if err != nil {
+			return false
+		}
+		reply := make([]byte, 8)
+		_, err = io.ReadFull(conn, reply)
+		return err == nil && reply[0] == 0x00 && reply[1] >= 0x5a && reply[1] <= 0x5d
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		return tlsConn.Handshake() == nil
+	}
+	return true
+}
+
+//protocols是验证通过的协议，第一个作为代理默认的协议
+func acceptProxy(proxy *Proxy, source string, protocols []string, timing Timing) {
+	proxy.Protocol = protocols[0]
+	proxy.Protocols = protocols
+	proxy.addTiming(timing)
+	proxy.LastChecked = time.Now()
+	removeNegativeCache(proxy.Address)
+	addProxy(proxy, source)
+	attributeProxy(source, proxy.Address)
+}
+
+//逐个验证方案检查代理，通过任意一个方案就算代理可用，返回通过方案里最快的耗时和每个方案的结果，
+//任意目标发现篡改都会标记tampered
+func checkProxy(ctx context.Context, proxy string) checkResult {
+	profiles := getCheckProfiles()
+	result := checkResult{profiles: make(map[string]bool, len(profiles))}
+	failedCount, downCount := 0, 0
+	for i := range profiles {
+		if ctx.Err() != nil {
+			result.ok = false
+			return result
+		}
+		timing, err := checkProxyProfile(ctx, proxy, profiles[i])
+		log.WithFields(logrus.Fields{"proxy": redactProxyUrl(proxy), "profile": profiles[i].Name, "err": err}).Info("验证方案结果")
+		//目标不可用时不知道代理能不能通过，不记录结果，入池时保留上次的结果
+		if err == errTargetDown {
+			downCount++
+			failedCount++
+			continue
+		}
+		result.profiles[profiles[i].Name] = err == nil
+		if err == errTampered {
+			result.tampered = true
+		}
+		if err != nil {
+			failedCount++
+			continue
+		}
+		if !result.ok || timing.Total < result.timing.Total {
+			result.timing = timing
+		}
+		result.ok = true
+	}
+	//只有失败的方案全部是因为目标不可用，才不算代理失败
+	result.targetDown = !result.ok && failedCount > 0 && downCount == failedCount
+	return result
+}
+
+//并发请求方案内的所有验证目标，通过数量达到quorum才算通过，返回通过目标的平均耗时。
+//不可用的目标不参与计算，所有目标都不可用时返回errTargetDown；任意目标发现篡改直接返回errTampered
+func checkProxyProfile(ctx context.Context, proxy string, profile CheckProfile) (Timing, error) {
+	targets := profile.Targets
+	if len(targets) == 0 {
+		return Timing{}, errors.New("验证方案没有验证目标")
+	}
+	timings := make([]Timing, len(targets))
+	errs := make([]error, len(targets))
+	var waitGroup sync.WaitGroup
+	for i := range targets {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			timings[i], errs[i] = checkProxyTarget(ctx, proxy, targets[i])
+			if ctx.Err() == nil {
+				recordTargetResult(targets[i].Url, errs[i] == nil)
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+
+	var passed []Timing
+	var lastErr error
+	upCount := 0
+	for i := range targets {
+		if errs[i] == errTampered {
+			return timings[i], errTampered
+		}
+		if errs[i] == nil {
+			passed = append(passed, timings[i])
+			upCount++
+			continue
+		}
+		lastErr = errs[i]
+		if ctx.Err() == nil && isTargetDown(ctx, targets[i]) {
+			continue
+		}
+		upCount++
+	}
+	if upCount == 0 {
+		return Timing{}, errTargetDown
+	}
+	quorum := profile.Quorum
+	if quorum == 0 || quorum > upCount {
+		quorum = upCount
+	}
+	if len(passed) < quorum {
+		return Timing{}, lastErr
+	}
+	return averageTiming(passed), nil
+}
+
+var errTampered = errors.New("代理篡改了响应或证书")
+var errTargetDown = errors.New("验证目标不可用")
+
+//----------------------------------------------------------------------------------------------------------------------
+
+var targetStatsLock sync.Mutex
+var targetStats = make(map[string]*targetStat)
+var targetWindow = time.Minute
+var targetDownMinSamples = 10
+var targetProbeTtl = 30 * time.Second
+
+//每个验证目标最近一段时间内经过代理请求的结果，以及不经过代理直接探测的结果
+type targetStat struct {
+	results []targetSample
+	probed  time.Time
+	probeOk bool
+}
+
+type targetSample struct {
+	time time.Time
+	ok   bool
+}
+
+type TargetStatus struct {
+	Url      string `json:"url"`
+	Samples  int    `json:"samples"`
+	Passed   int    `json:"passed"`
+	Down     bool   `json:"down"`
+	ProbedAt string `json:"probedAt"`
+}
+
+func getTargetStat(targetUrl string) *targetStat {
+	stat, ok := targetStats[targetUrl]
+	if !ok {
+		stat = &targetStat{}
+		targetStats[targetUrl] = stat
+	}
+	return stat
+}
+
+//只保留窗口内的结果，调用方需要持有targetStatsLock
+func (stat *targetStat) prune(now time.Time) {
+	index := 0
+	for index < len(stat.results) && now.Sub(stat.results[index].time) > targetWindow {
+		index++
+	}
+	stat.results = stat.results[index:]
+}
+
+func (stat *targetStat) count() (int, int) {
+	passed := 0
+	for i := range stat.results {
+		if stat.results[i].ok {
+			passed++
+		}
+	}
+	return len(stat.results), passed
+}
+
+func recordTargetResult(targetUrl string, ok bool) {
+	targetStatsLock.Lock()
+	defer targetStatsLock.Unlock()
+	now := time.Now()
+	stat := getTargetStat(targetUrl)
+	stat.prune(now)
+	stat.results = append(stat.results, targetSample{time: now, ok: ok})
+}
+
+//窗口内样本足够多并且经过所有代理都失败时，不经过代理直接探测确认，直接探测也失败才认为目标不可用。
+//本机网络断了也会被当成目标不可用，避免把池中代理全部移出
+func isTargetDown(ctx context.Context, target CheckTarget) bool {
+	targetStatsLock.Lock()
+	stat := getTargetStat(target.Url)
+	stat.prune(time.Now())
+	samples, passed := stat.count()
+	if samples < targetDownMinSamples || passed > 0 {
+		targetStatsLock.Unlock()
+		return false
+	}
+	if time.Since(stat.probed) < targetProbeTtl {
+		down := !stat.probeOk
+		targetStatsLock.Unlock()
+		return down
+	}
+	targetStatsLock.Unlock()
+
+	response, _, _, err := requestThroughProxy(ctx, "", target.Method, target.Url, nil)
+	probeOk := err == nil && response.StatusCode == target.Status
+	if ctx.Err() != nil {
+		return false
+	}
+	targetStatsLock.Lock()
+	stat.probed = time.Now()
+	stat.probeOk = probeOk
+	targetStatsLock.Unlock()
+	if !probeOk {
+		log.WithFields(logrus.Fields{"url": target.Url, "samples": samples, "err": err}).Warn("验证目标不可用，暂停按该目标淘汰代理")
+	}
+	return !probeOk
+}
+
+func listTargetStatus() []TargetStatus {
+	targetStatsLock.Lock()
+	defer targetStatsLock.Unlock()
+	var statuses []TargetStatus
+	now := time.Now()
+	for targetUrl, stat := range targetStats {
+		stat.prune(now)
+		samples, passed := stat.count()
+		status := TargetStatus{Url: targetUrl, Samples: samples, Passed: passed}
+		if !stat.probed.IsZero() {
+			status.ProbedAt = stat.probed.Format(time.RFC3339)
+			status.Down = !stat.probeOk && now.Sub(stat.probed) < targetProbeTtl && samples >= targetDownMinSamples && passed == 0
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Url < statuses[j].Url
+	})
+	return statuses
+}
+
+func checkProxyTarget(ctx context.Context, proxy string, target CheckTarget) (Timing, error) {
+	response, body, timing, err := requestThroughProxy(ctx, proxy, target.Method, target.Url, nil)
+	latency := timing.Total
+	log.WithFields(logrus.Fields{"url": target.Url, "err": err}).Info("验证目标请求")
+	if isCertificateError(err) {
+		log.WithFields(logrus.Fields{"url": target.Url, "err": err}).Warn("代理返回的证书校验失败，可能是中间人")
+		return timing, errTampered
+	}
+	if err != nil {
+		return timing, err
+	}
+
+	log.WithFields(logrus.Fields{"url": target.Url, "StatusCode": response.StatusCode}).Info("验证目标请求")
+	if response.StatusCode != target.Status {
+		return timing, errors.New("验证目标响应码异常")
+	}
+	if target.MaxLatency > 0 && latency > time.Duration(target.MaxLatency)*time.Millisecond {
+		log.WithFields(logrus.Fields{"url": target.Url, "latency": latency}).Info("验证目标延迟超出上限")
+		return timing, errors.New("验证目标延迟超出上限")
+	}
+	if isTampered(ctx, target, response, body) {
+		return timing, errTampered
+	}
+	if target.Selector == "" {
+		if !strings.Contains(body, target.Contains) {
+			return timing, errors.New("验证目标响应内容不匹配")
+		}
+		return timing, nil
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		log.WithFields(logrus.Fields{"url": target.Url, "err": err}).Error("验证目标，html解析失败")
+		return timing, err
+	}
+	selection := doc.Find(target.Selector)
+	if selection.Length() == 0 || !strings.Contains(selection.Text(), target.Contains) {
+		return timing, errors.New("验证目标响应内容不匹配")
+	}
+	return timing, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+var referenceLock sync.Mutex
+var references = make(map[string]reference)
+var referenceTtl = 10 * time.Minute
+
+//不经过代理直接请求验证目标得到的参考内容
+type reference struct {
+	injectCount int
+	fetched     time.Time
+}
+
+var injectPatterns = []string{"<script", "<iframe"}
+
+//只看和验证目标握手时的证书错误，和https代理本身握手失败（net/http包装成proxyconnect）只是代理不可用，不算篡改
+func isCertificateError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var opError *net.OpError
+	if errors.As(err, &opError) && opError.Op == "proxyconnect" {
+		return false
+	}
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var hostnameError x509.HostnameError
+	var certificateInvalidError x509.CertificateInvalidError
+	return errors.As(err, &unknownAuthorityError) || errors.As(err, &hostnameError) || errors.As(err, &certificateInvalidError)
+}
+
+//配置了Sha256时响应体哈希必须一致；配置了Pin时https证书公钥必须一致；
+//开启DetectInjection时，响应里的script、iframe比直接请求得到的参考内容多就认为被注入了内容
+func isTampered(ctx context.Context, target CheckTarget, response *http.Response, body string) bool {
+	if target.Sha256 != "" {
+		sum := sha256.Sum256([]byte(body))
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), target.Sha256) {
+			log.WithFields(logrus.Fields{"url": target.Url}).Warn("验证目标响应哈希不一致")
+			return true
+		}
+	}
+	if target.Pin != "" && response.TLS != nil && len(response.TLS.PeerCertificates) > 0 {
+		sum := sha256.Sum256(response.TLS.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		if base64.StdEncoding.EncodeToString(sum[:]) != target.Pin {
+			log.WithFields(logrus.Fields{"url": target.Url}).Warn("验证目标证书公钥和pin不一致")
+			return true
+		}
+	}
+	if target.DetectInjection {
+		expect, ok := getReference(ctx, target)
+		if ok && countInjection(body) > expect {
+			log.WithFields(logrus.Fields{"url": target.Url}).Warn("验证目标响应被注入了内容")
+			return true
+		}
+	}
+	return false
+}
+
+func countInjection(body string) int {
+	lower := strings.ToLower(body)
+	count := 0
+	for i := range injectPatterns {
+		count += strings.Count(lower, injectPatterns[i])
+	}
+	return count
+}
+
+func getReference(ctx context.Context, target CheckTarget) (int, bool) {
+	referenceLock.Lock()
+	cached, ok := references[target.Url]
+	referenceLock.Unlock()
+	if ok && time.Since(cached.fetched) < referenceTtl {
+		return cached.injectCount, true
+	}
+	_, body, _, err := requestThroughProxy(ctx, "", target.Method, target.Url, nil)
+	if err != nil {
+		log.WithFields(logrus.Fields{"url": target.Url, "err": err}).Error("直接请求验证目标获取参考内容失败")
+		return 0, false
+	}
+	cached = reference{injectCount: countInjection(body), fetched: time.Now()}
+	referenceLock.Lock()
+	references[target.Url] = cached
+	referenceLock.Unlock()
+	return cached.injectCount, true
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//一次请求各阶段的耗时：DNS解析、连上代理的TCP连接、经代理建立隧道（CONNECT或socks握手，https代理还包括和代理的TLS握手）、
+//和目标的TLS握手、请求发出到收到第一个字节
+type Timing struct {
+	Dns     time.Duration `json:"dns"`
+	Connect time.Duration `json:"connect"`
+	Tunnel  time.Duration `json:"tunnel"`
+	Tls     time.Duration `json:"tls"`
+	Ttfb    time.Duration `json:"ttfb"`
+	Total   time.Duration `json:"total"`
+}
+
+func averageTiming(timings []Timing) Timing {
+	var sum Timing
+	if len(timings) == 0 {
+		return sum
+	}
+	for i := range timings {
+		sum.Dns += timings[i].Dns
+		sum.Connect += timings[i].Connect
+		sum.Tunnel += timings[i].Tunnel
+		sum.Tls += timings[i].Tls
+		sum.Ttfb += timings[i].Ttfb
+		sum.Total += timings[i].Total
+	}
+	count := time.Duration(len(timings))
+	return Timing{Dns: sum.Dns / count, Connect: sum.Connect / count, Tunnel: sum.Tunnel / count, Tls: sum.Tls / count, Ttfb: sum.Ttfb / count, Total: sum.Total / count}
+}
+
+//保留最近timingSampleMax次的耗时，并更新总耗时的EWMA
+func (proxy *Proxy) addTiming(timing Timing) {
+	if timing.Total <= 0 {
+		return
+	}
+	proxy.Latency = timing.Total
+	proxy.Timings = append(proxy.Timings, timing)
+	if len(proxy.Timings) > timingSampleMax {
+		proxy.Timings = proxy.Timings[len(proxy.Timings)-timingSampleMax:]
+	}
+	if proxy.LatencyEwma == 0 {
+		proxy.LatencyEwma = timing.Total
+		return
+	}
+	proxy.LatencyEwma = time.Duration(timingEwmaAlpha*float64(timing.Total) + (1-timingEwmaAlpha)*float64(proxy.LatencyEwma))
+}
+
+//proxy为空时直接连接
+func newProxyTransport(proxy string) (*http.Transport, error) {
+	transport := &http.Transport{DisableKeepAlives: true}
+	if proxy == "" {
+		return transport, nil
+	}
+	proxyUrl, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyUrl.Scheme {
+	case "socks4", "socks4a":
+		transport.DialContext = socks4DialContext(proxyUrl.Host, proxyUrl.Scheme == "socks4a", proxyUrl.User.Username())
+	default:
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	return transport, nil
+}
+
+//proxy为空时直接请求，header可以为nil，响应体已经读完并关闭
+func requestThroughProxy(ctx context.Context, proxy string, method string, targetUrl string, header http.Header) (*http.Response, string, Timing, error) {
+	var timing Timing
+	transport, err := newProxyTransport(proxy)
+	if err != nil {
+		return nil, "", timing, err
+	}
+	client := &http.Client{Transport: transport, Timeout: timeout}
+	request, err := http.NewRequest(method, targetUrl, nil)
+	if err != nil {
+		return nil, "", timing, err
+	}
+	for name := range header {
+		request.Header[name] = header[name]
+	}
+	request.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.77 Safari/537.36")
+
+	var dnsStart, connectStart, connectDone, tlsStart, wroteRequest time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { timing.Dns = time.Since(dnsStart) },
+		ConnectStart: func(string, string) {
+			if connectStart.IsZero() {
+				connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(string, string, error) {
+			if connectDone.IsZero() {
+				connectDone = time.Now()
+				timing.Connect = connectDone.Sub(connectStart)
+			}
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			timing.Tls = time.Since(tlsStart)
+			if !connectDone.IsZero() {
+				timing.Tunnel = tlsStart.Sub(connectDone)
+			}
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { wroteRequest = time.Now() },
+		GotFirstResponseByte: func() { timing.Ttfb = time.Since(wroteRequest) },
+	}
+	request = request.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	startTime := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		timing.Total = time.Since(startTime)
+		return nil, "", timing, err
+	}
+	defer response.Body.Close()
+	bytes, err := ioutil.ReadAll(response.Body)
+	timing.Total = time.Since(startTime)
+	if err != nil {
+		return nil, "", timing, err
+	}
+	return response, string(bytes), timing, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//Contains为空时只检查响应码；设置了Selector时在选中元素的文本里找Contains；MaxLatency单位毫秒，0表示不限制；
+//Sha256是响应体的十六进制哈希，Pin是证书公钥（SubjectPublicKeyInfo）sha256的base64，用于发现篡改内容或中间人
+type CheckTarget struct {
+	Url             string `json:"url"`
+	Method          string `json:"method"`
+	Status          int    `json:"status"`
+	Contains        string `json:"contains"`
+	Selector        string `json:"selector"`
+	MaxLatency      int64  `json:"maxLatency"`
+	Sha256          string `json:"sha256"`
+	Pin             string `json:"pin"`
+	DetectInjection bool   `json:"detectInjection"`
+}
+
+var defaultCheckTargets = `[{"url":"https://www.baidu.com/","method":"GET","status":200,"selector":"title","contains":"百度一下，你就知道","maxLatency":0}]`
+
+//target.json是默认的验证方案，profile.json里是其他命名的验证方案，例如针对国内或者国外目标的方案
+//Quorum是需要通过的目标数量，例如3个目标里通过2个，0表示所有目标都要通过
+type CheckProfile struct {
+	Name    string        `json:"name"`
+	Targets []CheckTarget `json:"targets"`
+	Quorum  int           `json:"quorum"`
+}
+
+const defaultProfileName = "default"
+
+var checkProfilesLock sync.Mutex
+var checkProfiles []CheckProfile
+
+func getCheckProfiles() []CheckProfile {
+	checkProfilesLock.Lock()
+	defer checkProfilesLock.Unlock()
+	return checkProfiles
+}
+
+func loadCheckProfiles() error {
+	jsonString, err := readFileOrCreateIfNotExist(targetPath, defaultCheckTargets)
+	if err != nil {
+		return err
+	}
+	var targets []CheckTarget
+	err = json.Unmarshal([]byte(jsonString), &targets)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("反序列化验证目标json失败")
+		return err
+	}
+	jsonString, err = readFileOrCreateIfNotExist(profilePath, "[]")
+	if err != nil {
+		return err
+	}
+	var profiles []CheckProfile
+	err = json.Unmarshal([]byte(jsonString), &profiles)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("反序列化验证方案json失败")
+		return err
+	}
+	quorum, _ := strconv.Atoi(os.Getenv("CHECK_QUORUM"))
+	profiles = append([]CheckProfile{{Name: defaultProfileName, Targets: targets, Quorum: quorum}}, profiles...)
+	for i := range profiles {
+		for j := range profiles[i].Targets {
+			if profiles[i].Targets[j].Method == "" {
+				profiles[i].Targets[j].Method = http.MethodGet
+			}
+			if profiles[i].Targets[j].Status == 0 {
+				profiles[i].Targets[j].Status = http.StatusOK
+			}
+		}
+		if len(profiles[i].Targets) == 0 {
+			log.WithFields(logrus.Fields{"profile": profiles[i].Name}).Warn("验证方案没有验证目标，所有代理都无法通过该方案")
+		}
+		if profiles[i].Quorum < 0 || profiles[i].Quorum > len(profiles[i].Targets) {
+			log.WithFields(logrus.Fields{"profile": profiles[i].Name, "quorum": profiles[i].Quorum}).Warn("验证方案的quorum超出范围，改为所有目标都要通过")
+			profiles[i].Quorum = 0
+		}
+	}
+	checkProfilesLock.Lock()
+	defer checkProfilesLock.Unlock()
+	checkProfiles = profiles
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//验证失败的候选代理，重试间隔随失败次数指数增长；超出negativeCacheSize时淘汰最久没更新的
+type negativeEntry struct {
+	address   string
+	failCount int
+	nextRetry time.Time
+}
+
+var negativeCacheLock sync.Mutex
+var negativeCacheList = list.New()
+var negativeCacheMap = make(map[string]*list.Element)
+
+func isNegativeCached(address string, now time.Time) bool {
+	negativeCacheLock.Lock()
+	defer negativeCacheLock.Unlock()
+	element, ok := negativeCacheMap[address]
+	if !ok {
+		return false
+	}
+	return now.Before(element.Value.(*negativeEntry).nextRetry)
+}
+
+func addNegativeCache(address string, now time.Time) {
+	negativeCacheLock.Lock()
+	defer negativeCacheLock.Unlock()
+	element, ok := negativeCacheMap[address]
+	if !ok {
+		element = negativeCacheList.PushFront(&negativeEntry{address: address})
+		negativeCacheMap[address] = element
+	}
+	negativeCacheList.MoveToFront(element)
+	entry := element.Value.(*negativeEntry)
+	entry.failCount++
+	backoff := negativeCacheBackoff
+	for i := 1; i < entry.failCount && backoff < negativeCacheBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > negativeCacheBackoffMax {
+		backoff = negativeCacheBackoffMax
+	}
+	entry.nextRetry = now.Add(backoff)
+	for negativeCacheList.Len() > negativeCacheSize {
+		oldest := negativeCacheList.Back()
+		negativeCacheList.Remove(oldest)
+		delete(negativeCacheMap, oldest.Value.(*negativeEntry).address)
+	}
+}
+
+func removeNegativeCache(address string) {
+	negativeCacheLock.Lock()
+	defer negativeCacheLock.Unlock()
+	if element, ok := negativeCacheMap[address]; ok {
+		negativeCacheList.Remove(element)
+		delete(negativeCacheMap, address)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//MaxMind格式的城市库和ASN库，文件不存在时不做地理信息补充
+type geoDatabase struct {
+	path    string
+	modTime time.Time
+	reader  *maxminddb.Reader
+}
+
+type geoCityRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+type geoAsnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+var geoLock sync.RWMutex
+var geoCityDatabase = &geoDatabase{path: "GeoLite2-City.mmdb"}
+var geoAsnDatabase = &geoDatabase{path: "GeoLite2-ASN.mmdb"}
+
+//文件修改时间变了才重新加载，返回是否加载了新文件
+func (database *geoDatabase) reload() bool {
+	info, err := os.Stat(database.path)
+	if err != nil {
+		geoLock.RLock()
+		loaded := database.reader != nil
+		geoLock.RUnlock()
+		if loaded {
+			log.WithFields(logrus.Fields{"path": database.path, "err": err}).Error("读取地理信息库失败，继续使用已加载的库")
+		}
+		return false
+	}
+	geoLock.RLock()
+	unchanged := info.ModTime().Equal(database.modTime)
+	geoLock.RUnlock()
+	if unchanged {
+		return false
+	}
+	buffer, err := ioutil.ReadFile(database.path)
+	if err != nil {
+		log.WithFields(logrus.Fields{"path": database.path, "err": err}).Error("读取地理信息库失败")
+		return false
+	}
+	reader, err := maxminddb.FromBytes(buffer)
+	if err != nil {
+		log.WithFields(logrus.Fields{"path": database.path, "err": err}).Error("解析地理信息库失败")
+		return false
+	}
+	geoLock.Lock()
+	database.reader = reader
+	database.modTime = info.ModTime()
+	geoLock.Unlock()
+	log.WithFields(logrus.Fields{"path": database.path, "type": reader.Metadata.DatabaseType}).Info("加载地理信息库")
+	return true
+}
+
+func (database *geoDatabase) lookup(ip net.IP, result interface{}) bool {
+	geoLock.RLock()
+	defer geoLock.RUnlock()
+	if database.reader == nil {
+		return false
+	}
+	err := database.reader.Lookup(ip, result)
+	if err != nil {
+		log.WithFields(logrus.Fields{"path": database.path, "ip": ip.String(), "err": err}).Error("查询地理信息库失败")
+		return false
+	}
+	return true
+}
+
+func reloadGeoDatabases() bool {
+	cityReloaded := geoCityDatabase.reload()
+	asnReloaded := geoAsnDatabase.reload()
+	return cityReloaded || asnReloaded
+}
+
+//定期检查库文件和网段列表，替换后不用重启，并重新补充池中代理的地理信息和网络类型
+func autoReloadGeoDatabases(ctx context.Context) {
+	for sleepContext(ctx, geoReloadTick) {
+		geoReloaded := reloadGeoDatabases()
+		listReloaded := reloadNetworkLists()
+		if geoReloaded || listReloaded {
+			enrichGlobalProxies()
+			filterGlobalProxies()
+		}
+	}
+}
+
+//查询地理信息和网络类型用的ip，优先用出口ip，没有时用代理自身的ip
+func (proxy *Proxy) lookupIp() net.IP {
+	if ip := net.ParseIP(proxy.ExitIp); ip != nil {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(proxy.Address)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func enrichGeo(proxy *Proxy) {
+	ip := proxy.lookupIp()
+	if ip == nil {
+		return
+	}
+	var city geoCityRecord
+	if geoCityDatabase.lookup(ip, &city) {
+		proxy.Country = city.Country.IsoCode
+		proxy.City = city.City.Names["en"]
+	}
+	var asn geoAsnRecord
+	if geoAsnDatabase.lookup(ip, &asn) {
+		proxy.Asn = asn.Number
+		proxy.Org = asn.Organization
+	}
+	proxy.IpType = classifyIpType(ip, proxy.Asn)
+}
+
+func enrichGlobalProxies() {
+	globalProxiesLock.Lock()
+	defer globalProxiesLock.Unlock()
+	for i := range globalProxies {
+		enrichGeo(globalProxies[i])
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	ipTypeUnknown     = "unknown"
+	ipTypeDatacenter  = "datacenter"
+	ipTypeResidential = "residential"
+)
+
+//运营者提供的网段列表文件，每行一个CIDR、ip、AS号（AS13335）或者两位国家代码，#或;后面是注释，兼容DROP格式。
+//匹配结果是命中的规则，格式为"文件:行号 规则"，用于日志
+type networkList struct {
+	paths     []string
+	modTime   map[string]time.Time
+	nets      []networkRule
+	asns      map[uint]string
+	countries map[string]string
+}
+
+type networkRule struct {
+	ipNet *net.IPNet
+	rule  string
+}
+
+var networkListLock sync.RWMutex
+var datacenterList = &networkList{paths: []string{"datacenter.txt"}}
+var residentialList = &networkList{paths: []string{"residential.txt"}}
+var allowList = &networkList{paths: []string{"allow.txt"}}
+var denyList = &networkList{paths: []string{"deny.txt"}}
+
+//多个文件用逗号分隔
+func splitPaths(paths string) []string {
+	var result []string
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			result = append(result, path)
+		}
+	}
+	return result
+}
+
+//任意文件修改时间变了就重新读取全部文件，返回是否重新加载了
+func (networks *networkList) reload() bool {
+	modTime := make(map[string]time.Time)
+	for _, path := range networks.paths {
+		if info, err := os.Stat(path); err == nil {
+			modTime[path] = info.ModTime()
+		}
+	}
+	networkListLock.RLock()
+	changed := len(modTime) != len(networks.modTime)
+	for path := range modTime {
+		changed = changed || !modTime[path].Equal(networks.modTime[path])
+	}
+	networkListLock.RUnlock()
+	if !changed {
+		return false
+	}
+	var nets []networkRule
+	asns := make(map[uint]string)
+	countries := make(map[string]string)
+	for path := range modTime {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.WithFields(logrus.Fields{"path": path, "err": err}).Error("读取网段列表失败")
+			continue
+		}
+		for number, line := range strings.Split(string(content), "\n") {
+			if index := strings.IndexAny(line, "#;"); index >= 0 {
+				line = line[:index]
+			}
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+			rule := fmt.Sprintf("%s:%d %s", path, number+1, line)
+			if strings.HasPrefix(strings.ToUpper(line), "AS") {
+				if asn, err := strconv.ParseUint(line[2:], 10, 32); err == nil {
+					asns[uint(asn)] = rule
+					continue
+				}
+			}
+			if isCountryCode(line) {
+				countries[strings.ToUpper(line)] = rule
+				continue
+			}
+			if !strings.Contains(line, "/") {
+				if ip := net.ParseIP(line); ip != nil && ip.To4() != nil {
+					line += "/32"
+				} else {
+					line += "/128"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(line)
+			if err != nil {
+				log.WithFields(logrus.Fields{"path": path, "line": line}).Warn("网段列表里无法解析的行")
+				continue
+			}
+			nets = append(nets, networkRule{ipNet: ipNet, rule: rule})
+		}
+	}
+	networkListLock.Lock()
+	networks.nets = nets
+	networks.asns = asns
+	networks.countries = countries
+	networks.modTime = modTime
+	networkListLock.Unlock()
+	log.WithFields(logrus.Fields{"paths": networks.paths, "nets": len(nets), "asns": len(asns), "countries": len(countries)}).Info("加载网段列表")
+	return true
+}
+
+func isCountryCode(line string) bool {
+	if len(line) != 2 {
+		return false
+	}
+	for _, c := range strings.ToUpper(line) {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+//返回命中的规则，没命中返回空字符串
+func (networks *networkList) match(ip net.IP, asn uint, country string) string {
+	networkListLock.RLock()
+	defer networkListLock.RUnlock()
+	if rule, ok := networks.asns[asn]; ok && asn != 0 {
+		return rule
+	}
+	if rule, ok := networks.countries[strings.ToUpper(country)]; ok && country != "" {
+		return rule
+	}
+	for i := range networks.nets {
+		if networks.nets[i].ipNet.Contains(ip) {
+			return networks.nets[i].rule
+		}
 	}
-	loadGlobalProxies()
+	return ""
 }
 
-func main() {
-	go autoFlushProxy()
-	startWebService()
+func (networks *networkList) empty() bool {
+	networkListLock.RLock()
+	defer networkListLock.RUnlock()
+	return len(networks.nets) == 0 && len(networks.asns) == 0 && len(networks.countries) == 0
 }
 
-//----------------------------------------------------------------------------------------------------------------------
-
-func startWebService() {
-	log.Info("开始web服务")
-	engine := gin.Default()
-	engine.POST("/add", func(context *gin.Context) {
-		proxiesString := context.PostForm("proxies")
-		log.WithFields(logrus.Fields{"proxiesString": proxiesString}).Info("添加代理数据json")
-		context.JSON(http.StatusOK, createResponseData(proxiesString, addProxyByJson(proxiesString)))
-	})
-	engine.GET("/get", func(context *gin.Context) {
-		context.JSON(http.StatusOK, createResponseData(getProxy(), nil))
-	})
-	engine.GET("/list", func(context *gin.Context) {
-		context.JSON(http.StatusOK, createResponseData(globalProxies, nil))
-	})
-	engine.Run(address)
-	log.Info("结束web服务")
+func reloadNetworkLists() bool {
+	reloaded := false
+	for _, networks := range []*networkList{datacenterList, residentialList, allowList, denyList} {
+		if networks.reload() {
+			reloaded = true
+		}
+	}
+	return reloaded
 }
 
-func createResponseData(data interface{}, err error) interface{} {
-	if err == nil {
-		return gin.H{"code": 1, "massage": err, "data": data}
-	} else {
-		return gin.H{"code": 2, "massage": err, "data": data}
+//命中机房列表为datacenter，命中住宅列表为residential，都没命中为unknown。
+//机房列表通常不全，不能把没命中的当作residential
+func classifyIpType(ip net.IP, asn uint) string {
+	if datacenterList.match(ip, asn, "") != "" {
+		return ipTypeDatacenter
+	}
+	if residentialList.match(ip, asn, "") != "" {
+		return ipTypeResidential
 	}
+	return ipTypeUnknown
 }
 
 //----------------------------------------------------------------------------------------------------------------------
 
-func getProxy() string {
-	globalProxiesLock.Lock()
-	defer globalProxiesLock.Unlock()
-	proxy := ""
-	if len(globalProxies) > 0 {
-		proxy = globalProxies[rand.Intn(len(globalProxies))]
+//命中禁止列表的拒绝；配置了允许列表时，没命中允许列表的也拒绝。返回拒绝的原因，允许时返回空字符串
+func checkIpRules(ip net.IP) string {
+	var asn geoAsnRecord
+	geoAsnDatabase.lookup(ip, &asn)
+	var city geoCityRecord
+	geoCityDatabase.lookup(ip, &city)
+	if rule := denyList.match(ip, asn.Number, city.Country.IsoCode); rule != "" {
+		return fmt.Sprintf("命中禁止规则 %s", rule)
 	}
-	return proxy
+	if !allowList.empty() && allowList.match(ip, asn.Number, city.Country.IsoCode) == "" {
+		return "不在允许列表中"
+	}
+	return ""
 }
 
-func addProxy(proxy string) {
-	globalProxiesLock.Lock()
-	defer globalProxiesLock.Unlock()
-	if proxy == "" {
-		return
+//代理自身ip和出口ip都要检查，地址是域名时只能检查出口ip。返回被拒绝的ip和原因
+func checkProxyRules(proxy *Proxy) (string, string) {
+	ips := []string{proxy.ExitIp}
+	if host, _, err := net.SplitHostPort(proxy.Address); err == nil {
+		ips = append(ips, host)
 	}
-	if _, ok := globalProxiesMap[proxy]; ok {
-		return
+	for _, ipString := range ips {
+		ip := net.ParseIP(ipString)
+		if ip == nil {
+			continue
+		}
+		if reason := checkIpRules(ip); reason != "" {
+			return ipString, reason
+		}
 	}
-	globalProxiesMap[proxy] = proxy
-	globalProxies = append(globalProxies, proxy)
+	return "", ""
 }
 
-func addProxies(proxies []string) {
+//规则变化后移出池中不再允许的代理
+func filterGlobalProxies() {
 	globalProxiesLock.Lock()
 	defer globalProxiesLock.Unlock()
-	if proxies == nil || len(proxies) == 0 {
-		return
-	}
-	for i := range proxies {
-		if _, ok := globalProxiesMap[proxies[i]]; ok {
+	var proxies []*Proxy
+	for i := range globalProxies {
+		if ip, reason := checkProxyRules(globalProxies[i]); reason != "" {
+			log.WithFields(logrus.Fields{"address": globalProxies[i].Address, "ip": ip, "rule": reason}).Warn("代理被访问规则拒绝，移出代理池")
+			delete(globalProxiesMap, globalProxies[i].Address)
 			continue
 		}
-		globalProxiesMap[proxies[i]] = proxies[i]
-		globalProxies = append(globalProxies, proxies[i])
+		proxies = append(proxies, globalProxies[i])
 	}
+	globalProxies = proxies
 }
 
-func loadGlobalProxies() error {
-	jsonString, err := readFileOrCreateIfNotExist(dataPath, "[]")
-	if err != nil {
-		return err
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	anonymityUnknown     = "unknown"
+	anonymityTransparent = "transparent"
+	anonymityAnonymous   = "anonymous"
+	anonymityElite       = "elite"
+)
+
+//会暴露使用了代理的请求头
+var proxyHeaders = []string{"Via", "X-Forwarded-For", "Forwarded", "Forwarded-For", "X-Real-Ip", "Client-Ip", "X-Client-Ip", "X-Proxy-Id", "Proxy-Connection", "X-Bluecoat-Via"}
+
+type JudgeData struct {
+	Ip      string            `json:"ip"`
+	Headers map[string]string `json:"headers"`
+}
+
+var realIpLock sync.Mutex
+
+//带宽测试的下载数据，用随机内容避免被代理压缩
+var payloadBlock = func() []byte {
+	block := make([]byte, 32*1024)
+	rand.Read(block)
+	return block
+}()
+
+type payloadReader struct{}
+
+func (payloadReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		n += copy(p[n:], payloadBlock)
 	}
-	err = addProxyByJson(jsonString)
+	return n, nil
+}
+
+//回显请求的来源ip和请求头，不能用gin的ClientIP，它会信任X-Forwarded-For
+func judge(request *http.Request) JudgeData {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
 	if err != nil {
-		return err
+		ip = request.RemoteAddr
 	}
-	var proxies []string
-	for i := range globalProxies {
-		proxies = append(proxies, strings.Split(globalProxies[i], "//")[1])
+	headers := make(map[string]string, len(request.Header))
+	for name := range request.Header {
+		headers[name] = strings.Join(request.Header[name], ", ")
 	}
-	globalProxies = []string{}
-	globalProxiesMap = make(map[string]string)
-	checkProxies(proxies)
-	return saveGlobalProxies()
+	return JudgeData{Ip: ip, Headers: headers}
 }
 
-func addProxyByJson(jsonString string) error {
-	var proxies []string
-	err := json.Unmarshal([]byte(jsonString), &proxies)
-	if err != nil {
-		log.WithFields(logrus.Fields{"err": err}).Error("反序列化代理数据json失败")
-		return err
+func anonymityLevel(anonymity string) int {
+	switch anonymity {
+	case anonymityTransparent:
+		return 1
+	case anonymityAnonymous:
+		return 2
+	case anonymityElite:
+		return 3
 	}
-	log.WithFields(logrus.Fields{"proxies": proxies}).Info("反序列化代理数据json成功")
-	addProxies(proxies)
-	return nil
+	return 0
 }
 
-func saveGlobalProxies() error {
-	globalProxiesLock.Lock()
-	defer globalProxiesLock.Unlock()
-	bytes, err := json.Marshal(globalProxies)
+//通过代理请求JUDGE_URL（需要是http链接，https隧道里代理加不了请求头），
+//请求头或来源ip里有本机真实ip为transparent，只有代理相关请求头为anonymous，都没有为elite。
+//返回匿名等级和出口ip，judge看到的来源ip就是出口ip；没有配置JUDGE_URL时用ECHO_URL只检测出口ip
+func checkAnonymity(ctx context.Context, proxy string) (string, string) {
+	if judgeUrl == "" {
+		return anonymityUnknown, requestEcho(ctx, proxy)
+	}
+	data, err := requestJudge(ctx, proxy)
 	if err != nil {
-		log.WithFields(logrus.Fields{"err": err}).Error("序列化globalProxies失败")
-		return err
+		return anonymityUnknown, ""
 	}
-	err = writeFileOrCreateIfNotExist(dataPath, bytes)
-	return err
+	localIp := getRealIp(ctx)
+	if localIp == "" {
+		return anonymityUnknown, data.Ip
+	}
+	anonymity := classifyAnonymity(data, localIp)
+	log.WithFields(logrus.Fields{"proxy": redactProxyUrl(proxy), "anonymity": anonymity, "exitIp": data.Ip}).Info("代理匿名等级")
+	return anonymity, data.Ip
 }
 
-//----------------------------------------------------------------------------------------------------------------------
-
-func writeFileOrCreateIfNotExist(filePath string, text []byte) error {
-	_, err := os.Stat(filePath)
-	if err == nil || os.IsExist(err) {
-		err = ioutil.WriteFile(filePath, text, 0644)
-		if err != nil {
-			log.WithFields(logrus.Fields{"err": err}).Error("写入文件失败")
+//ECHO_URL返回纯文本ip，或者带ip属性的json，例如https://api.ipify.org
+func requestEcho(ctx context.Context, proxy string) string {
+	if echoUrl == "" {
+		return ""
+	}
+	response, body, _, err := requestThroughProxy(ctx, proxy, http.MethodGet, echoUrl, nil)
+	log.WithFields(logrus.Fields{"err": err}).Info("echo请求")
+	if err != nil || response.StatusCode != 200 {
+		return ""
+	}
+	ip := strings.TrimSpace(body)
+	if gjson.Valid(body) {
+		for _, path := range []string{"ip", "origin", "data.ip"} {
+			if result := gjson.Get(body, path); result.Exists() {
+				ip = result.String()
+				break
+			}
 		}
-		return err
 	}
-	return createFile(filePath, text)
+	if net.ParseIP(ip) == nil {
+		log.WithFields(logrus.Fields{"body": body}).Error("echo响应里没有合法ip")
+		return ""
+	}
+	return ip
 }
 
-func readFileOrCreateIfNotExist(filePath string, defaultText string) (string, error) {
-	_, err := os.Stat(filePath)
-	if err == nil || os.IsExist(err) {
-		bytes, err := readFile(filePath)
-		if err != nil {
-			return "", err
+func classifyAnonymity(data JudgeData, localIp string) string {
+	if data.Ip == localIp {
+		return anonymityTransparent
+	}
+	for name := range data.Headers {
+		if strings.Contains(data.Headers[name], localIp) {
+			return anonymityTransparent
 		}
-		text := string(bytes)
-		log.WithFields(logrus.Fields{"text": text}).Info("读取文件文本")
-		return text, err
 	}
-	err = createFile(filePath, []byte(defaultText))
-	return defaultText, err
-}
-
-func createFile(filePath string, defaultData []byte) error {
-	folderPath, _ := path.Split(filePath)
-	log.WithFields(logrus.Fields{"folderPath": folderPath}).Info("文件父文件夹")
-	if folderPath != "" {
-		err := os.MkdirAll(folderPath, 0666)
-		if err != nil {
-			log.WithFields(logrus.Fields{"err": err}).Error("创建父文件夹失败")
-			return err
+	for i := range proxyHeaders {
+		if _, ok := data.Headers[http.CanonicalHeaderKey(proxyHeaders[i])]; ok {
+			return anonymityAnonymous
 		}
 	}
+	return anonymityElite
+}
 
-	file, err := os.Create(filePath)
-	if err != nil {
-		log.WithFields(logrus.Fields{"err": err}).Error("创建文件失败")
-		return err
+//没有配置REAL_IP时，不经过代理直接请求JUDGE_URL得到本机出口ip
+func getRealIp(ctx context.Context) string {
+	realIpLock.Lock()
+	defer realIpLock.Unlock()
+	if realIp != "" {
+		return realIp
 	}
-	defer file.Close()
-	_, err = file.Write(defaultData)
+	data, err := requestJudge(ctx, "")
 	if err != nil {
-		log.WithFields(logrus.Fields{"err": err}).Error("写入文件初始文本失败")
+		return ""
 	}
-	return err
+	realIp = data.Ip
+	log.WithFields(logrus.Fields{"realIp": realIp}).Info("本机出口ip")
+	return realIp
 }
 
-func readFile(filePath string) ([]byte, error) {
-	file, err := os.Open(filePath)
+func requestJudge(ctx context.Context, proxy string) (JudgeData, error) {
+	var data JudgeData
+	response, body, _, err := requestThroughProxy(ctx, proxy, http.MethodGet, judgeUrl, nil)
+	log.WithFields(logrus.Fields{"err": err}).Info("judge请求")
 	if err != nil {
-		log.WithFields(logrus.Fields{"err": err}).Error("打开文件失败")
-		return nil, err
+		return data, errors.New("judge请求异常")
 	}
-	defer file.Close()
-	bytes, err := ioutil.ReadAll(file)
+
+	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode}).Info("judge请求")
+	if response.StatusCode != 200 {
+		return data, errors.New("judge响应码异常")
+	}
+	result := gjson.Get(body, "data")
+	if !result.IsObject() {
+		log.Error("judge响应json没有data属性")
+		return data, errors.New("judge响应json没有data属性")
+	}
+	err = json.Unmarshal([]byte(result.Raw), &data)
 	if err != nil {
-		log.Error("读取文件失败")
-		return nil, err
+		log.WithFields(logrus.Fields{"err": err}).Error("反序列化judge响应json失败")
+		return data, err
 	}
-	return bytes, err
+	return data, nil
 }
 
 //----------------------------------------------------------------------------------------------------------------------
 
-func autoFlushProxy() {
-	for {
-		flushProxy()
+type Source struct {
+	Name         string    `json:"name"`
+	Url          string    `json:"url"`
+	FailCount    int       `json:"failCount"`
+	SuspendCount int       `json:"suspendCount"`
+	SuspendUntil time.Time `json:"suspendUntil"`
+	Suspended    bool      `json:"suspended"`
+	Reported     int       `json:"reported"`
+	Validated    int       `json:"validated"`
+	YieldRate    float64   `json:"yieldRate"`
+	SurvivalRate float64   `json:"survivalRate"`
+	Interval     int       `json:"interval"`
+	Wait         int       `json:"wait"`
+	Trust        string    `json:"trust"`
+	fetch        func(ctx context.Context) []string
+	//代理第一次通过验证的时间，用于计算存活率
+	firstValidated map[string]time.Time
+}
+
+var sourcesLock sync.Mutex
+var sources = []*Source{
+	{Name: "kuaidaili", Url: "https://www.kuaidaili.com/free/inha/1/", fetch: kuaidaili},
+	{Name: "66ip", Url: "http://www.66ip.cn/1.html", fetch: _66ip},
+	{Name: "cnProxy", Url: "http://cn-proxy.com/", fetch: cnProxy},
+	{Name: "ihuan", Url: "https://ip.ihuan.me/", fetch: ihuan},
+	{Name: "proxyList", Url: "https://www.proxy-list.download/api/v0/get?l=en&t=http", fetch: wwwProxyList},
+	{Name: "proxyDaily", Url: "https://proxy-daily.com/", fetch: proxyDaily},
+	{Name: "proxyFish", Url: "https://www.proxyfish.com/proxylist/server_processing.php", fetch: proxyFish},
+	{Name: "sslProxies", Url: "https://www.sslproxies.org/", fetch: sslProxies},
+}
+
+//连续失败sourceFailMax个周期后暂停代理源，冷却时间随暂停次数指数增长，冷却结束后再试探一次
+//产出率高的代理源每个周期都抓取，产出率低的按比例隔几个周期才抓取一次
+func fetchSources(ctx context.Context) {
+	for i := range sources {
+		if ctx.Err() != nil {
+			break
+		}
+		if isSourceSuspended(sources[i], time.Now()) {
+			log.WithFields(logrus.Fields{"name": sources[i].Name, "suspendUntil": sources[i].SuspendUntil}).Info("代理源暂停中，跳过")
+			continue
+		}
+		if isSourceWaiting(sources[i]) {
+			log.WithFields(logrus.Fields{"name": sources[i].Name, "interval": sources[i].Interval}).Info("代理源产出率低，本周期跳过")
+			continue
+		}
+		proxies := sources[i].fetch(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		log.WithFields(logrus.Fields{"name": sources[i].Name, "count": len(proxies)}).Info("代理源抓取结果")
+		recordSourceResult(sources[i], len(proxies) > 0)
+		reportSourceProxies(sources[i], len(proxies))
+		checkProxiesWithTrust(ctx, sources[i].Name, sources[i].Trust, proxies)
+	}
+	saveSources()
+}
+
+func isSourceWaiting(source *Source) bool {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	if source.Wait > 0 {
+		source.Wait--
+		return true
 	}
+	source.Wait = source.Interval - 1
+	return false
 }
 
-func flushProxy() {
+func reportSourceProxies(source *Source, count int) {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	source.Reported += count
+}
+
+func attributeProxy(name string, proxy string) {
+	if name == "" {
+		return
+	}
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	for i := range sources {
+		if sources[i].Name != name {
+			continue
+		}
+		sources[i].Validated++
+		if sources[i].firstValidated == nil {
+			sources[i].firstValidated = make(map[string]time.Time)
+		}
+		if _, ok := sources[i].firstValidated[proxy]; !ok {
+			sources[i].firstValidated[proxy] = time.Now()
+		}
+	}
+}
+
+func updateSourceStats() {
 	globalProxiesLock.Lock()
-	var proxies []string
-	for i := range globalProxies {
-		proxies = append(proxies, strings.Split(globalProxies[i], "//")[1])
+	alive := make(map[string]bool, len(globalProxiesMap))
+	for proxy := range globalProxiesMap {
+		alive[proxy] = true
 	}
-	globalProxies = []string{}
-	globalProxiesMap = make(map[string]string)
 	globalProxiesLock.Unlock()
-	checkProxies(proxies)
-
-	checkProxies(kuaidaili())
-	checkProxies(_66ip())
-	checkProxies(cnProxy())
-	checkProxies(ihuan())
-	checkProxies(wwwProxyList())
-	checkProxies(proxyDaily())
-	checkProxies(proxyFish())
-	checkProxies(sslProxies())
-	saveGlobalProxies()
+
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	now := time.Now()
+	bestYieldRate := 0.0
+	for i := range sources {
+		if sources[i].Reported > 0 {
+			sources[i].YieldRate = float64(sources[i].Validated) / float64(sources[i].Reported)
+		}
+		if sources[i].YieldRate > bestYieldRate {
+			bestYieldRate = sources[i].YieldRate
+		}
+		survivedCount := 0
+		agedCount := 0
+		for proxy, firstValidated := range sources[i].firstValidated {
+			age := now.Sub(firstValidated)
+			if age > sourceStatWindow {
+				delete(sources[i].firstValidated, proxy)
+				continue
+			}
+			if age < sourceSurviveAge {
+				continue
+			}
+			agedCount++
+			if alive[proxy] {
+				survivedCount++
+			}
+		}
+		if agedCount > 0 {
+			sources[i].SurvivalRate = float64(survivedCount) / float64(agedCount)
+		}
+	}
+	for i := range sources {
+		sources[i].Interval = sourceInterval(sources[i], bestYieldRate)
+		if sources[i].Wait >= sources[i].Interval {
+			sources[i].Wait = sources[i].Interval - 1
+		}
+	}
 }
 
-func checkProxies(proxies []string) {
-	for i := range proxies {
-		checkProxyChan <- proxies[i]
+func sourceInterval(source *Source, bestYieldRate float64) int {
+	if source.Reported == 0 || bestYieldRate == 0 {
+		return 1
+	}
+	if source.YieldRate == 0 {
+		return sourceIntervalMax
+	}
+	interval := int(math.Ceil(bestYieldRate / source.YieldRate))
+	if interval > sourceIntervalMax {
+		interval = sourceIntervalMax
 	}
+	return interval
 }
 
-func checkAndAddProxy() {
-	for {
-		proxy := <-checkProxyChan
-		httpProxy := fmt.Sprintf("http://%s", proxy)
-		log.WithFields(logrus.Fields{"httpProxy": httpProxy}).Info("代理链接")
-		if checkProxy(httpProxy) {
-			addProxy(httpProxy)
+func isSourceSuspended(source *Source, now time.Time) bool {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	return now.Before(source.SuspendUntil)
+}
+
+func recordSourceResult(source *Source, ok bool) {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	if ok {
+		source.FailCount = 0
+		source.SuspendCount = 0
+		source.SuspendUntil = time.Time{}
+		return
+	}
+	source.FailCount++
+	if source.SuspendCount == 0 && source.FailCount < sourceFailMax {
+		return
+	}
+	source.SuspendCount++
+	cooldown := sourceCooldown
+	for i := 1; i < source.SuspendCount && cooldown < sourceCooldownMax; i++ {
+		cooldown *= 2
+	}
+	if cooldown > sourceCooldownMax {
+		cooldown = sourceCooldownMax
+	}
+	source.SuspendUntil = time.Now().Add(cooldown)
+	log.WithFields(logrus.Fields{"name": source.Name, "failCount": source.FailCount, "cooldown": cooldown}).Warn("代理源连续失败，暂停抓取")
+}
+
+func enableSource(name string) error {
+	sourcesLock.Lock()
+	for i := range sources {
+		if sources[i].Name != name {
 			continue
 		}
-		socks5Proxy := fmt.Sprintf("socks5://%s", proxy)
-		log.WithFields(logrus.Fields{"socks5Proxy": socks5Proxy}).Info("代理链接")
-		if checkProxy(socks5Proxy) {
-			addProxy(httpProxy)
-			continue
+		sources[i].FailCount = 0
+		sources[i].SuspendCount = 0
+		sources[i].SuspendUntil = time.Time{}
+		sourcesLock.Unlock()
+		return saveSources()
+	}
+	sourcesLock.Unlock()
+	return errors.New("代理源不存在")
+}
+
+func listSources() []Source {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	now := time.Now()
+	var states []Source
+	for i := range sources {
+		source := *sources[i]
+		source.Suspended = now.Before(source.SuspendUntil)
+		source.firstValidated = nil
+		states = append(states, source)
+	}
+	return states
+}
+
+func loadSources() error {
+	jsonString, err := readFileOrCreateIfNotExist(sourcePath, "[]")
+	if err != nil {
+		return err
+	}
+	var states []Source
+	err = json.Unmarshal([]byte(jsonString), &states)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("反序列化代理源状态json失败")
+		return err
+	}
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	for i := range states {
+		for j := range sources {
+			if sources[j].Name != states[i].Name {
+				continue
+			}
+			sources[j].FailCount = states[i].FailCount
+			sources[j].SuspendCount = states[i].SuspendCount
+			sources[j].SuspendUntil = states[i].SuspendUntil
+			sources[j].Reported = states[i].Reported
+			sources[j].Validated = states[i].Validated
+			sources[j].YieldRate = states[i].YieldRate
+			sources[j].SurvivalRate = states[i].SurvivalRate
+			sources[j].Interval = states[i].Interval
+			sources[j].Wait = states[i].Wait
 		}
-		httpsProxy := fmt.Sprintf("https://%s", proxy)
-		log.WithFields(logrus.Fields{"httpsProxy": httpsProxy}).Info("代理链接")
-		if checkProxy(httpsProxy) {
-			addProxy(httpProxy)
-			continue
+	}
+	return nil
+}
+
+func saveSources() error {
+	bytes, err := json.Marshal(listSources())
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("序列化代理源状态失败")
+		return err
+	}
+	return writeFileOrCreateIfNotExist(sourcePath, bytes)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//full：直接入池不验证；reduced：只验证peer给出的协议；none：和普通代理源一样完整验证
+const (
+	trustNone    = "none"
+	trustReduced = "reduced"
+	trustFull    = "full"
+)
+
+type Peer struct {
+	Name  string `json:"name"`
+	Url   string `json:"url"`
+	Token string `json:"token"`
+	Trust string `json:"trust"`
+}
+
+//从peer.json读取其他proxyReptile实例，作为代理源拉取它们的/list
+func loadPeers() error {
+	jsonString, err := readFileOrCreateIfNotExist(peerPath, "[]")
+	if err != nil {
+		return err
+	}
+	var peers []Peer
+	err = json.Unmarshal([]byte(jsonString), &peers)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("反序列化peer数据json失败")
+		return err
+	}
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	for i := range peers {
+		peer := peers[i]
+		if peer.Trust != trustFull && peer.Trust != trustReduced {
+			peer.Trust = trustNone
 		}
+		log.WithFields(logrus.Fields{"name": peer.Name, "url": peer.Url, "trust": peer.Trust}).Info("添加peer代理源")
+		sources = append(sources, &Source{
+			Name:  fmt.Sprintf("peer-%s", peer.Name),
+			Url:   peer.Url,
+			Trust: peer.Trust,
+			fetch: func(ctx context.Context) []string { return fetchPeer(ctx, peer) },
+		})
 	}
+	return nil
 }
 
-func checkProxy(proxy string) bool {
-	request := gorequest.New().Proxy(proxy)
-	response, body, errs := request.Get("https://www.baidu.com/").
-		Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.77 Safari/537.36").
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("www.baidu.com请求")
-	if errs != nil && len(errs) > 0 {
-		return false
+func fetchPeer(ctx context.Context, peer Peer) []string {
+	for i := 0; i < retry && ctx.Err() == nil; i++ {
+		jsonString, err := requestPeer(ctx, peer)
+		if err == nil {
+			proxies, _ := analysisPeer(peer, jsonString)
+			if proxies == nil {
+				proxies = []string{}
+			}
+			return proxies
+		}
 	}
+	return []string{}
+}
 
-	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode}).Info("www.baidu.com请求")
-	if response.StatusCode != 200 {
-		return false
+func analysisPeer(peer Peer, jsonString string) ([]string, error) {
+	if !gjson.Valid(jsonString) {
+		log.WithFields(logrus.Fields{"name": peer.Name}).Error("peer响应json非法")
+		return nil, errors.New("peer响应json非法")
+	}
+	result := gjson.Get(jsonString, "data")
+	if !result.IsArray() {
+		log.WithFields(logrus.Fields{"name": peer.Name}).Error("peer响应json没有data数组")
+		return nil, errors.New("peer响应json没有data数组")
+	}
+	var proxies []string
+	results := result.Array()
+	for i := range results {
+		proxy := results[i].String()
+		if results[i].IsObject() {
+			peerProxy := &Proxy{Protocol: results[i].Get("protocol").String(), Address: results[i].Get("address").String()}
+			//peer没给管理员权限时认证信息是隐藏的，这种代理用不了
+			peerProxy.Username = results[i].Get("username").String()
+			peerProxy.Password = results[i].Get("password").String()
+			if peerProxy.Username == redactedCredential {
+				continue
+			}
+			proxy = peerProxy.Url()
+		}
+		if proxy != "" {
+			proxies = append(proxies, proxy)
+		}
 	}
+	return proxies, nil
+}
 
-	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+func requestPeer(ctx context.Context, peer Peer) (string, error) {
+	url := fmt.Sprintf("%s/list", strings.TrimSuffix(peer.Url, "/"))
+	log.WithFields(logrus.Fields{"url": url}).Info("peer请求url")
+	header := http.Header{}
+	if peer.Token != "" {
+		header.Set("Authorization", fmt.Sprintf("Bearer %s", peer.Token))
+	}
+	response, body, _, err := requestThroughProxy(ctx, "", http.MethodGet, url, header)
+	log.WithFields(logrus.Fields{"err": err}).Info("peer请求")
 	if err != nil {
-		log.WithFields(logrus.Fields{"err": err}).Error("www.baidu.com，html解析失败")
-		return false
+		return "", errors.New("peer请求异常")
 	}
-	return strings.Contains(doc.Find("title").Text(), "百度一下，你就知道")
+
+	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode}).Info("peer请求")
+	if response.StatusCode != 200 {
+		return "", errors.New("peer响应码异常")
+	}
+	return body, nil
 }
 
 //----------------------------------------------------------------------------------------------------------------------
 
 //https://www.kuaidaili.com/free/inha/1/
-func kuaidaili() []string {
+func kuaidaili(ctx context.Context) []string {
 	var proxyList []string
-	for page := 1; page < pageMax; page++ {
-		for i := 0; i < retry; i++ {
-			html, err := requestKuaidaili(page)
+	for page := 1; page < pageMax && ctx.Err() == nil; page++ {
+		for i := 0; i < retry && ctx.Err() == nil; i++ {
+			html, err := requestKuaidaili(ctx, page)
 			if err == nil {
 				proxies, _ := analysisKuaidaili(html)
 				if proxies == nil {
@@ -356,15 +3340,12 @@ func analysisKuaidaili(html string) ([]string, error) {
 	return httpProxies, nil
 }
 
-func requestKuaidaili(page int) (string, error) {
+func requestKuaidaili(ctx context.Context, page int) (string, error) {
 	url := fmt.Sprintf("https://www.kuaidaili.com/free/inha/%d/", page)
 	log.WithFields(logrus.Fields{"url": url}).Info("www.kuaidaili.com请求url")
-	request := gorequest.New().Proxy(getProxy())
-	response, body, errs := request.Get(url).
-		Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.77 Safari/537.36").
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("www.kuaidaili.com请求")
-	if errs != nil && len(errs) > 0 {
+	response, body, _, err := requestThroughProxy(ctx, getProxyUrl(), http.MethodGet, url, nil)
+	log.WithFields(logrus.Fields{"err": err}).Info("www.kuaidaili.com请求")
+	if err != nil {
 		return "", errors.New("www.kuaidaili.com请求异常")
 	}
 
@@ -378,11 +3359,11 @@ func requestKuaidaili(page int) (string, error) {
 //----------------------------------------------------------------------------------------------------------------------
 
 //http://www.66ip.cn/1.html
-func _66ip() []string {
+func _66ip(ctx context.Context) []string {
 	var proxyList []string
-	for page := 1; page < pageMax; page++ {
-		for i := 0; i < retry; i++ {
-			html, err := request66ip(page)
+	for page := 1; page < pageMax && ctx.Err() == nil; page++ {
+		for i := 0; i < retry && ctx.Err() == nil; i++ {
+			html, err := request66ip(ctx, page)
 			if err == nil {
 				proxies, _ := analysis66ip(html)
 				if proxies == nil {
@@ -418,15 +3399,12 @@ func analysis66ip(html string) ([]string, error) {
 	return httpProxies, nil
 }
 
-func request66ip(page int) (string, error) {
+func request66ip(ctx context.Context, page int) (string, error) {
 	url := fmt.Sprintf("http://www.66ip.cn/%d.html", page)
 	log.WithFields(logrus.Fields{"url": url}).Info("www.66ip.cn请求url")
-	request := gorequest.New().Proxy(getProxy())
-	response, body, errs := request.Get(url).
-		Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.77 Safari/537.36").
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("www.66ip.cn请求")
-	if errs != nil && len(errs) > 0 {
+	response, body, _, err := requestThroughProxy(ctx, getProxyUrl(), http.MethodGet, url, nil)
+	log.WithFields(logrus.Fields{"err": err}).Info("www.66ip.cn请求")
+	if err != nil {
 		return "", errors.New("www.66ip.cn请求异常")
 	}
 
@@ -440,9 +3418,9 @@ func request66ip(page int) (string, error) {
 //----------------------------------------------------------------------------------------------------------------------
 
 //http://cn-proxy.com/
-func cnProxy() []string {
-	for i := 0; i < retry; i++ {
-		html, err := requestCnProxy()
+func cnProxy(ctx context.Context) []string {
+	for i := 0; i < retry && ctx.Err() == nil; i++ {
+		html, err := requestCnProxy(ctx)
 		if err == nil {
 			proxies, _ := analysisCnProxy(html)
 			if proxies == nil {
@@ -473,13 +3451,10 @@ func analysisCnProxy(html string) ([]string, error) {
 	return httpProxies, nil
 }
 
-func requestCnProxy() (string, error) {
-	request := gorequest.New().Proxy(getProxy())
-	response, body, errs := request.Get("http://cn-proxy.com/").
-		Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.77 Safari/537.36").
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("cn-proxy.com请求")
-	if errs != nil && len(errs) > 0 {
+func requestCnProxy(ctx context.Context) (string, error) {
+	response, body, _, err := requestThroughProxy(ctx, getProxyUrl(), http.MethodGet, "http://cn-proxy.com/", nil)
+	log.WithFields(logrus.Fields{"err": err}).Info("cn-proxy.com请求")
+	if err != nil {
 		return "", errors.New("cn-proxy.com请求异常")
 	}
 
@@ -493,9 +3468,9 @@ func requestCnProxy() (string, error) {
 //----------------------------------------------------------------------------------------------------------------------
 
 //https://ip.ihuan.me/
-func ihuan() []string {
-	for i := 0; i < retry; i++ {
-		html, err := requestIhuan()
+func ihuan(ctx context.Context) []string {
+	for i := 0; i < retry && ctx.Err() == nil; i++ {
+		html, err := requestIhuan(ctx)
 		if err == nil {
 			proxies, _ := analysisIhuan(html)
 			if proxies == nil {
@@ -525,13 +3500,10 @@ func analysisIhuan(html string) ([]string, error) {
 	return httpProxies, nil
 }
 
-func requestIhuan() (string, error) {
-	request := gorequest.New().Proxy(getProxy())
-	response, body, errs := request.Get("https://ip.ihuan.me/").
-		Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.77 Safari/537.36").
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("ip.ihuan.m请求")
-	if errs != nil && len(errs) > 0 {
+func requestIhuan(ctx context.Context) (string, error) {
+	response, body, _, err := requestThroughProxy(ctx, getProxyUrl(), http.MethodGet, "https://ip.ihuan.me/", nil)
+	log.WithFields(logrus.Fields{"err": err}).Info("ip.ihuan.m请求")
+	if err != nil {
 		return "", errors.New("ip.ihuan.m请求异常")
 	}
 
@@ -545,9 +3517,9 @@ func requestIhuan() (string, error) {
 //----------------------------------------------------------------------------------------------------------------------
 
 //https://www.proxy-list.download/api/v0/get?l=en&t=http
-func wwwProxyList() []string {
-	for i := 0; i < retry; i++ {
-		jsonString, err := requestProxyList()
+func wwwProxyList(ctx context.Context) []string {
+	for i := 0; i < retry && ctx.Err() == nil; i++ {
+		jsonString, err := requestProxyList(ctx)
 		if err == nil {
 			proxies, _ := analysisProxyList(jsonString)
 			if proxies == nil {
@@ -582,15 +3554,10 @@ func analysisProxyList(jsonString string) ([]string, error) {
 	return proxies, nil
 }
 
-func requestProxyList() (string, error) {
-	request := gorequest.New().Proxy(getProxy())
-	response, body, errs := request.Get(fmt.Sprintf("https://www.proxy-list.download/api/v0/get")).
-		Param("l", "en").
-		Param("t", "http").
-		Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.77 Safari/537.36").
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("proxy-list.com请求")
-	if errs != nil && len(errs) > 0 {
+func requestProxyList(ctx context.Context) (string, error) {
+	response, body, _, err := requestThroughProxy(ctx, getProxyUrl(), http.MethodGet, "https://www.proxy-list.download/api/v0/get?l=en&t=http", nil)
+	log.WithFields(logrus.Fields{"err": err}).Info("proxy-list.com请求")
+	if err != nil {
 		return "", errors.New("proxy-list.com请求异常")
 	}
 
@@ -604,9 +3571,9 @@ func requestProxyList() (string, error) {
 //----------------------------------------------------------------------------------------------------------------------
 
 //https://proxy-daily.com/
-func proxyDaily() []string {
-	for i := 0; i < retry; i++ {
-		html, err := requestProxyDaily()
+func proxyDaily(ctx context.Context) []string {
+	for i := 0; i < retry && ctx.Err() == nil; i++ {
+		html, err := requestProxyDaily(ctx)
 		if err == nil {
 			proxies, _ := analysisProxyDaily(html)
 			if proxies == nil {
@@ -636,13 +3603,10 @@ func analysisProxyDaily(html string) ([]string, error) {
 	return httpProxies, nil
 }
 
-func requestProxyDaily() (string, error) {
-	request := gorequest.New().Proxy(getProxy())
-	response, body, errs := request.Get(fmt.Sprintf("https://proxy-daily.com/")).
-		Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.77 Safari/537.36").
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("proxy-daily.com请求")
-	if errs != nil && len(errs) > 0 {
+func requestProxyDaily(ctx context.Context) (string, error) {
+	response, body, _, err := requestThroughProxy(ctx, getProxyUrl(), http.MethodGet, "https://proxy-daily.com/", nil)
+	log.WithFields(logrus.Fields{"err": err}).Info("proxy-daily.com请求")
+	if err != nil {
 		return "", errors.New("proxy-daily.com请求异常")
 	}
 
@@ -656,9 +3620,9 @@ func requestProxyDaily() (string, error) {
 //----------------------------------------------------------------------------------------------------------------------
 
 //https://hidemy.name/en/proxy-list/?start=0
-func proxyFish() []string {
-	for i := 0; i < retry; i++ {
-		html, err := requestProxyFish()
+func proxyFish(ctx context.Context) []string {
+	for i := 0; i < retry && ctx.Err() == nil; i++ {
+		html, err := requestProxyFish(ctx)
 		if err == nil {
 			proxies, _ := analysisProxyFish(html)
 			if proxies == nil {
@@ -702,13 +3666,10 @@ func analysisProxyFish(jsonString string) ([]string, error) {
 	return httpProxies, nil
 }
 
-func requestProxyFish() (string, error) {
-	request := gorequest.New().Proxy(getProxy())
-	response, body, errs := request.Get(fmt.Sprintf("https://www.proxyfish.com/proxylist/server_processing.php")).
-		Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.77 Safari/537.36").
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("www.proxyfish.com请求")
-	if errs != nil && len(errs) > 0 {
+func requestProxyFish(ctx context.Context) (string, error) {
+	response, body, _, err := requestThroughProxy(ctx, getProxyUrl(), http.MethodGet, "https://www.proxyfish.com/proxylist/server_processing.php", nil)
+	log.WithFields(logrus.Fields{"err": err}).Info("www.proxyfish.com请求")
+	if err != nil {
 		return "", errors.New("www.proxyfish.com请求异常")
 	}
 
@@ -722,9 +3683,9 @@ func requestProxyFish() (string, error) {
 //----------------------------------------------------------------------------------------------------------------------
 
 //https://www.sslproxies.org/
-func sslProxies() []string {
-	for i := 0; i < retry; i++ {
-		html, err := requestSslProxies()
+func sslProxies(ctx context.Context) []string {
+	for i := 0; i < retry && ctx.Err() == nil; i++ {
+		html, err := requestSslProxies(ctx)
 		if err == nil {
 			proxies, _ := analysisSslProxies(html)
 			if proxies == nil {
@@ -754,13 +3715,10 @@ func analysisSslProxies(html string) ([]string, error) {
 	return httpProxies, nil
 }
 
-func requestSslProxies() (string, error) {
-	request := gorequest.New().Proxy(getProxy())
-	response, body, errs := request.Get("https://www.sslproxies.org/").
-		Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.77 Safari/537.36").
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("www.sslproxies.org请求")
-	if errs != nil && len(errs) > 0 {
+func requestSslProxies(ctx context.Context) (string, error) {
+	response, body, _, err := requestThroughProxy(ctx, getProxyUrl(), http.MethodGet, "https://www.sslproxies.org/", nil)
+	log.WithFields(logrus.Fields{"err": err}).Info("www.sslproxies.org请求")
+	if err != nil {
 		return "", errors.New("www.sslproxies.org请求异常")
 	}
 